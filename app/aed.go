@@ -0,0 +1,153 @@
+package app
+
+import (
+	"encoding/binary"
+	"encoding/csv"
+	"fmt"
+	"github.com/herrfz/coordnode/rng"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// payload of the AED temperature test app, all fields big endian:
+//
+//	[0]      message type, 0xa0
+//	[1]      sequence counter, 1 on the first message
+//	[2:6]    temperature in 1/100 °C, signed
+//	[6:10]   battery voltage in mV
+//	[10:18]  unused, zero
+//	[18:20]  trailer, sent unchanged; it is not a CRC of the message
+const (
+	AED_MSG_TEMPERATURE = 0xa0
+	AED_PAYLOAD_LEN     = 20
+)
+
+var AEDTrailer = []byte{0xc6, 0xe0}
+
+// temperature in °C at a time since the node started
+type Profile interface {
+	Temperature(elapsed time.Duration) float64
+}
+
+type ConstantProfile struct {
+	Value float64
+}
+
+func (p ConstantProfile) Temperature(elapsed time.Duration) float64 {
+	return p.Value
+}
+
+// daily cycle, highest at Peak into every Period
+type SineProfile struct {
+	Mean, Amplitude float64
+	Period, Peak    time.Duration
+}
+
+func (p SineProfile) Temperature(elapsed time.Duration) float64 {
+	phase := 2 * math.Pi * float64(elapsed-p.Peak) / float64(p.Period)
+	return p.Mean + p.Amplitude*math.Cos(phase)
+}
+
+// normally distributed steps from Start, one per call, kept within Min and Max
+type RandomWalkProfile struct {
+	Start, Step, Min, Max float64
+	Rand                  *rng.Rand // the global source if nil
+	current               float64
+	started               bool
+}
+
+func (p *RandomWalkProfile) Temperature(elapsed time.Duration) float64 {
+	if !p.started {
+		p.current, p.started = p.Start, true
+	} else {
+		p.current = math.Max(p.Min, math.Min(p.Max, p.current+p.Rand.NormFloat64()*p.Step))
+	}
+	return p.current
+}
+
+// recorded temperatures, each held until the next one; the trace repeats
+// after its last entry
+type TraceProfile struct {
+	Times  []time.Duration // ascending, from zero
+	Values []float64
+}
+
+// parse a trace from CSV rows of seconds since the start and temperature in °C
+func ParseTrace(r io.Reader) (TraceProfile, error) {
+	p := TraceProfile{}
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return p, err
+	}
+	for i, row := range rows {
+		if len(row) != 2 {
+			return p, fmt.Errorf("trace line %d: expected seconds and temperature", i+1)
+		}
+		secs, err := strconv.ParseFloat(strings.TrimSpace(row[0]), 64)
+		t := time.Duration(secs * float64(time.Second))
+		if err != nil || t < 0 || (len(p.Times) > 0 && t <= p.Times[len(p.Times)-1]) {
+			return p, fmt.Errorf("trace line %d: invalid time %q, must be ascending", i+1, row[0])
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(row[1]), 64)
+		if err != nil {
+			return p, fmt.Errorf("trace line %d: invalid temperature %q", i+1, row[1])
+		}
+		p.Times = append(p.Times, t)
+		p.Values = append(p.Values, value)
+	}
+	if len(p.Values) == 0 {
+		return p, fmt.Errorf("empty trace")
+	}
+	return p, nil
+}
+
+func (p TraceProfile) Temperature(elapsed time.Duration) float64 {
+	last := p.Times[len(p.Times)-1]
+	if last > 0 {
+		elapsed %= last
+	} else {
+		elapsed = 0
+	}
+	i := 0
+	for i+1 < len(p.Times) && p.Times[i+1] <= elapsed {
+		i++
+	}
+	return p.Values[i]
+}
+
+// battery voltage in mV, decaying linearly down to Min
+type Battery struct {
+	Start float64 `json:"start"`
+	Min   float64 `json:"min"`
+	Decay float64 `json:"decay"` // mV per hour
+}
+
+func (b Battery) Voltage(elapsed time.Duration) float64 {
+	return math.Max(b.Min, b.Start-b.Decay*elapsed.Hours())
+}
+
+// AEDGenerator builds the payloads of the AED temperature test app
+type AEDGenerator struct {
+	Temperature Profile
+	Battery     Battery
+	seq         byte
+}
+
+func (g *AEDGenerator) Payload(elapsed time.Duration) []byte {
+	g.seq++
+	payload := make([]byte, AED_PAYLOAD_LEN)
+	payload[0] = AED_MSG_TEMPERATURE
+	payload[1] = g.seq
+	binary.BigEndian.PutUint32(payload[2:6], uint32(int32(math.Round(g.Temperature.Temperature(elapsed)*100))))
+	SetAEDVoltage(payload, g.Battery.Voltage(elapsed))
+	copy(payload[18:], AEDTrailer)
+	return payload
+}
+
+// set the battery voltage of a payload, in mV
+func SetAEDVoltage(payload []byte, mv float64) {
+	binary.BigEndian.PutUint32(payload[6:10], uint32(math.Round(mv)))
+}
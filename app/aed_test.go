@@ -0,0 +1,86 @@
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSensorDefaults(t *testing.T) {
+	s, err := NewSensor(nil)
+	if err != nil {
+		t.Fatalf("error creating sensor app: %v", err.Error())
+	}
+	// the message captured from the AED temperature test app
+	expected, _ := hex.DecodeString("a001000008ad000017700000000000000000c6e0")
+	if payload := s.Generator.Payload(0); !bytes.Equal(payload, expected) {
+		t.Errorf("wrong output: %x, expected: %x", payload, expected)
+	}
+	if payload := s.Generator.Payload(time.Hour); payload[1] != 2 {
+		t.Errorf("wrong output: %v, expected: %v", payload[1], 2)
+	}
+}
+
+func TestSensorParams(t *testing.T) {
+	params := `{"temperature": {"profile": "sine", "mean": 20, "amplitude": 5, "period": "24h", "peak": "14h"}, "battery": {"start": 6000, "min": 4000, "decay": 200}}`
+	s, err := NewSensor(json.RawMessage(params))
+	if err != nil {
+		t.Fatalf("error creating sensor app: %v", err.Error())
+	}
+	payload := s.Generator.Payload(14 * time.Hour)
+	if temp := payload[2:6]; !bytes.Equal(temp, []byte{0x00, 0x00, 0x09, 0xc4}) { // 25.00 °C
+		t.Errorf("wrong output: %x, expected: %x", temp, []byte{0x00, 0x00, 0x09, 0xc4})
+	}
+	if mv := payload[6:10]; !bytes.Equal(mv, []byte{0x00, 0x00, 0x0f, 0xa0}) { // clamped at 4000 mV
+		t.Errorf("wrong output: %x, expected: %x", mv, []byte{0x00, 0x00, 0x0f, 0xa0})
+	}
+
+	for _, params := range []string{
+		`{"interval": "soon"}`,
+		`{"temperature": {"profile": "ramp"}}`,
+		`{"temperature": {"profile": "randomwalk", "start": 30, "min": 0, "max": 25}}`,
+		`{"temperature": {"profile": "csv", "file": "/nonexistent"}}`,
+		`{"battery": {"start": 3000, "min": 3300}}`,
+	} {
+		if _, err := NewSensor(json.RawMessage(params)); err == nil {
+			t.Errorf("no error creating sensor app with %s", params)
+		}
+	}
+}
+
+func TestTraceProfile(t *testing.T) {
+	trace, err := ParseTrace(strings.NewReader("0, 20.5\n60, 21\n120, 19.75\n"))
+	if err != nil {
+		t.Fatalf("error parsing trace: %v", err.Error())
+	}
+	// held until the next entry, repeated after the last
+	for _, test := range []struct {
+		elapsed time.Duration
+		out     float64
+	}{{0, 20.5}, {59 * time.Second, 20.5}, {90 * time.Second, 21}, {150 * time.Second, 20.5}, {185 * time.Second, 21}} {
+		if temp := trace.Temperature(test.elapsed); temp != test.out {
+			t.Errorf("wrong output: %v, expected: %v", temp, test.out)
+		}
+	}
+
+	for _, csv := range []string{"", "0, 20\n0, 21\n", "0\n", "0, warm\n"} {
+		if _, err := ParseTrace(strings.NewReader(csv)); err == nil {
+			t.Errorf("no error parsing %q", csv)
+		}
+	}
+}
+
+func TestRandomWalkProfile(t *testing.T) {
+	p := &RandomWalkProfile{Start: 20, Step: 5, Min: 18, Max: 22}
+	if temp := p.Temperature(0); temp != 20 {
+		t.Errorf("wrong output: %v, expected: %v", temp, 20)
+	}
+	for i := 0; i < 100; i++ {
+		if temp := p.Temperature(0); temp < 18 || temp > 22 {
+			t.Errorf("wrong output: %v, expected within 18 and 22", temp)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+// This package implements the applications running on emulated nodes
+package app
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/herrfz/coordnode/rng"
+	"github.com/herrfz/coordnode/serialport"
+	"sort"
+	"strings"
+)
+
+// what an application sees of the node it runs on
+type NodeInfo struct {
+	Addr   []byte // short address, little endian
+	EUI    []byte // EUI-64, canonical byte order
+	PAN    []byte // PAN identifier, frame byte order
+	Secure bool   // uplinks are authenticated
+}
+
+// keys of the node, nil until established over the air
+type Keys struct {
+	NIK, S, AK, SIK, SCK []byte
+}
+
+// counters of the uplinks of a node since it started
+type LinkCounters struct {
+	Sent     uint32  // frames sent on the air
+	Received uint32  // frames received by the coordinator
+	ED       float64 // mean ED of the received frames
+}
+
+// NodeContext is the node an application runs on
+type NodeContext interface {
+	Node() NodeInfo
+	Keys() Keys
+	Device() serialport.Config // serial device given to the app, if any
+	EnergyDetect() byte        // energy on the channel measured by the node, 0..255
+	LinkCounters() LinkCounters
+	BatteryVoltage() float64 // mV, 0 if the node has no battery model
+	Rand() *rng.Rand         // random source of the node, for reproducible runs
+
+	// send application data to the wdc, framed and secured by the node; fails
+	// once the app is stopped
+	SendUplink(payload []byte) error
+
+	// replace the NFC data the node sends with its association request
+	SetNFCData(data []byte) error
+}
+
+// App is the behaviour of an emulated node
+type App interface {
+	// Start runs the app until ctx is done; an error stops the node, which is
+	// then restarted
+	Start(ctx context.Context, node NodeContext) error
+
+	// OnDownlink is called with the application data of every downlink sent
+	// to the node, from another goroutine than Start
+	OnDownlink(payload []byte)
+}
+
+// creates an app from the params of its scenario entry, nil if none are given
+type Factory func(params json.RawMessage) (App, error)
+
+var registry = map[string]Factory{}
+
+// Register makes an app available by name to the scenario; it is meant to be
+// called from init
+func Register(name string, factory Factory) {
+	if _, dup := registry[name]; dup {
+		panic("app: Register called twice for " + name)
+	}
+	registry[name] = factory
+}
+
+func New(name string, params json.RawMessage) (App, error) {
+	factory, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown app %q, expected one of %s", name, strings.Join(Names(), ", "))
+	}
+	return factory(params)
+}
+
+// names of the registered apps, sorted
+func Names() []string {
+	var names []string
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// factory of apps without parameters
+func noParams(name string, new func() App) Factory {
+	return func(params json.RawMessage) (App, error) {
+		if len(params) != 0 && string(params) != "null" {
+			return nil, fmt.Errorf("%s app takes no parameters", name)
+		}
+		return new(), nil
+	}
+}
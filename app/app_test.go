@@ -0,0 +1,18 @@
+package app
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	if a, err := New("sensor", nil); err != nil || a == nil {
+		t.Errorf("error creating sensor app: %v", err)
+	}
+	if _, err := New("sensor", json.RawMessage(`{"rate": 1}`)); err == nil {
+		t.Errorf("no error creating sensor app with parameters")
+	}
+	if _, err := New("thermostat", nil); err == nil {
+		t.Errorf("no error creating unknown app")
+	}
+}
@@ -1,32 +1,47 @@
 package app
 
 import (
+	"context"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
-	"math/rand"
+	"github.com/herrfz/coordnode/clock"
 	"time"
 )
 
-func DoSendJamming(appDlCh, appUlCh, crossCh chan []byte, device string) {
-	ED := byte(0)
-	basePayload := []byte{0x00, 0x01, // battery voltage
+func init() {
+	Register("jamming", noParams("jamming", func() App { return &Jamming{} }))
+}
+
+// Jamming sends jamming reports: the energy measured on the channel, along with
+// battery voltage and temperature
+type Jamming struct{}
+
+func (j *Jamming) Start(ctx context.Context, node NodeContext) error {
+	basePayload := []byte{0x00, 0x01, // battery voltage in mV, if the node has a battery model
 		0x00, 0x10} // temperature
 
 LOOP:
 	for {
 		select {
-		case <-time.Tick(time.Duration(rand.Intn(5)) + 7*1000*time.Millisecond): // add 5ms jitter
-			payload := append(basePayload, ED)
-			ED += 1
-			appUlCh <- payload
-			fmt.Println("sent jamming data:", hex.EncodeToString(payload))
-
-		case _, more := <-appDlCh:
-			if !more {
-				close(appUlCh)
+		case <-clock.After(7*time.Second + time.Duration(node.Rand().Intn(5))*time.Millisecond): // add 5ms jitter
+			payload := append(basePayload[:4:4], node.EnergyDetect())
+			if mv := node.BatteryVoltage(); mv > 0 {
+				binary.BigEndian.PutUint16(payload[0:2], uint16(mv))
+			}
+			if err := node.SendUplink(payload); err != nil {
 				break LOOP
 			}
+			fmt.Println("sent jamming data:", hex.EncodeToString(payload))
+
+		case <-ctx.Done():
+			break LOOP
 		}
 	}
 	fmt.Println("stopped sending jamming measurement data")
+	return nil
+}
+
+func (j *Jamming) OnDownlink(payload []byte) {
+	fmt.Println("jamming app received downlink:", hex.EncodeToString(payload))
 }
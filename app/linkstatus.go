@@ -0,0 +1,160 @@
+package app
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/herrfz/coordnode/clock"
+	"math"
+	"strings"
+	"time"
+)
+
+func init() {
+	Register("linkstatus", func(params json.RawMessage) (App, error) { return NewLinkStatus(params) })
+}
+
+// payload of a WAIC link status report, cf. the bytemapping file:
+//
+//	[0]      message type, 0x01
+//	[1:5]    battery status
+//	[5:17]   status of link 0
+//	[17:29]  status of link 1
+//
+// and the status of a link, multi-byte fields little endian:
+//
+//	[0]      link number
+//	[1]      report sequence number, the same for both links
+//	[2:6]    WAIC sequence number, i.e. frames sent
+//	[6:10]   frames received successfully
+//	[10:12]  mean ED, 8.8 fixed point
+const (
+	LINK_STATUS_MSG    = 0x01
+	LINK_STATUS_LEN    = 29
+	LINK_STATUS_LINKS  = 2
+	LINK_STATUS_RECORD = 12
+)
+
+// battery status of the captured report; its encoding is not documented
+var DefaultBatteryStatus = [4]byte{0xcb, 0x1a, 0x14, 0x0d}
+
+type LinkStatus struct {
+	Sent, Received uint32
+	ED             float64
+}
+
+type LinkStatusReport struct {
+	Battery [4]byte
+	Seq     byte
+	Links   [LINK_STATUS_LINKS]LinkStatus
+}
+
+func (r LinkStatusReport) Bytes() []byte {
+	payload := make([]byte, LINK_STATUS_LEN)
+	payload[0] = LINK_STATUS_MSG
+	copy(payload[1:5], r.Battery[:])
+	for i, l := range r.Links {
+		rec := payload[5+i*LINK_STATUS_RECORD : 5+(i+1)*LINK_STATUS_RECORD]
+		rec[0] = byte(i)
+		rec[1] = r.Seq
+		binary.LittleEndian.PutUint32(rec[2:6], l.Sent)
+		binary.LittleEndian.PutUint32(rec[6:10], l.Received)
+		binary.LittleEndian.PutUint16(rec[10:12], uint16(math.Round(math.Min(l.ED, 255)*256)))
+	}
+	return payload
+}
+
+func ParseLinkStatusReport(payload []byte) (LinkStatusReport, error) {
+	r := LinkStatusReport{}
+	if len(payload) != LINK_STATUS_LEN {
+		return r, fmt.Errorf("link status report: wrong length %d, expected %d", len(payload), LINK_STATUS_LEN)
+	}
+	if payload[0] != LINK_STATUS_MSG {
+		return r, fmt.Errorf("link status report: wrong message type 0x%02x", payload[0])
+	}
+	copy(r.Battery[:], payload[1:5])
+	for i := range r.Links {
+		rec := payload[5+i*LINK_STATUS_RECORD : 5+(i+1)*LINK_STATUS_RECORD]
+		if rec[0] != byte(i) {
+			return r, fmt.Errorf("link status report: link %d numbered %d", i, rec[0])
+		}
+		if i == 0 {
+			r.Seq = rec[1]
+		}
+		r.Links[i] = LinkStatus{
+			Sent:     binary.LittleEndian.Uint32(rec[2:6]),
+			Received: binary.LittleEndian.Uint32(rec[6:10]),
+			ED:       float64(binary.LittleEndian.Uint16(rec[10:12])) / 256,
+		}
+	}
+	return r, nil
+}
+
+// LinkStatusApp sends link status reports filled from the counters of the
+// node; the node has a single link, the second one is reported unused
+type LinkStatusApp struct {
+	Interval time.Duration
+	Battery  [4]byte
+	seq      byte
+}
+
+// NewLinkStatus creates a link status app from its params, nil for the defaults
+func NewLinkStatus(params json.RawMessage) (*LinkStatusApp, error) {
+	p := struct {
+		Interval string `json:"interval"`
+		Battery  string `json:"battery"` // hex
+	}{"10s", hex.EncodeToString(DefaultBatteryStatus[:])}
+	if len(params) != 0 && string(params) != "null" {
+		dec := json.NewDecoder(strings.NewReader(string(params)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("linkstatus params: %s", err.Error())
+		}
+	}
+
+	a := &LinkStatusApp{}
+	var err error
+	if a.Interval, err = time.ParseDuration(p.Interval); err != nil || a.Interval <= 0 {
+		return nil, fmt.Errorf("linkstatus params: invalid interval %q", p.Interval)
+	}
+	battery, err := hex.DecodeString(p.Battery)
+	if err != nil || len(battery) != len(a.Battery) {
+		return nil, fmt.Errorf("linkstatus params: battery must be %d hex bytes", len(a.Battery))
+	}
+	copy(a.Battery[:], battery)
+	return a, nil
+}
+
+// report of the current counters of the node
+func (a *LinkStatusApp) Report(node NodeContext) LinkStatusReport {
+	c := node.LinkCounters()
+	r := LinkStatusReport{Battery: a.Battery, Seq: a.seq}
+	r.Links[0] = LinkStatus{Sent: c.Sent, Received: c.Received, ED: c.ED}
+	a.seq++
+	return r
+}
+
+func (a *LinkStatusApp) Start(ctx context.Context, node NodeContext) error {
+LOOP:
+	for {
+		select {
+		case <-clock.After(a.Interval + time.Duration(node.Rand().Intn(5))*time.Millisecond): // add 5ms jitter
+			payload := a.Report(node).Bytes()
+			if err := node.SendUplink(payload); err != nil {
+				break LOOP
+			}
+			fmt.Println("sent link status:", hex.EncodeToString(payload))
+
+		case <-ctx.Done():
+			break LOOP
+		}
+	}
+	fmt.Println("stopped sending link status")
+	return nil
+}
+
+func (a *LinkStatusApp) OnDownlink(payload []byte) {
+	fmt.Println("link status app received downlink:", hex.EncodeToString(payload))
+}
@@ -0,0 +1,33 @@
+package app
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestLinkStatusReport(t *testing.T) {
+	// payload of the report in the bytemapping file
+	payload, _ := hex.DecodeString("01cb1a140d00088a01000089010000f03f01088a010000000000000000")
+	r, err := ParseLinkStatusReport(payload)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err.Error())
+	}
+	if r.Battery != DefaultBatteryStatus || r.Seq != 8 {
+		t.Errorf("wrong output: %x %v, expected: %x 8", r.Battery, r.Seq, DefaultBatteryStatus)
+	}
+	link := LinkStatus{Sent: 394, Received: 393, ED: 63.9375}
+	if r.Links[0] != link || r.Links[1] != (LinkStatus{Sent: 394}) {
+		t.Errorf("wrong output: %+v, expected: %+v", r.Links, link)
+	}
+	if out := r.Bytes(); !bytes.Equal(out, payload) {
+		t.Errorf("wrong output: %x, expected: %x", out, payload)
+	}
+
+	for _, bad := range []string{"01cb1a", "02" + hex.EncodeToString(payload[1:])} {
+		buf, _ := hex.DecodeString(bad)
+		if _, err := ParseLinkStatusReport(buf); err == nil {
+			t.Errorf("no error parsing %v", bad)
+		}
+	}
+}
@@ -2,15 +2,24 @@ package app
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/herrfz/devreader"
-	"github.com/tarm/goserial"
+	"github.com/herrfz/coordnode/serialport"
 	"io"
-	"os"
 	"regexp"
 )
 
+func init() {
+	// the device is taken from the params by the scenario
+	Register("forward", func(params json.RawMessage) (App, error) { return &Forwarder{}, nil })
+}
+
+// read something that is not an NFC packet, the reader just continues
+var errNoPacket = errors.New("DONTPANIC")
+
 type SerialReader struct {
 	serial io.ReadWriteCloser
 }
@@ -43,7 +52,7 @@ func (s SerialReader) ReadDevice() ([]byte, error) {
 				lengthBytes := []byte{lsr[BUFSIZE-1], lsr[BUFSIZE-2]}
 				tempLen, _ := hex.DecodeString(string(lengthBytes))
 				if len(tempLen) == 0 {
-					return nil, fmt.Errorf("DONTPANIC")
+					return nil, errNoPacket
 				}
 				remLen := 3*int(tempLen[0]) - 24 // times three to take the ascii encoding, i.e. one byte is encoded as two character ascii (e.g. 18 is a one and an eight), and the whitespaces into account
 				rest := make([]byte, remLen)
@@ -64,7 +73,7 @@ func (s SerialReader) ReadDevice() ([]byte, error) {
 					wholePacket, _ := hex.DecodeString(packet.String())
 					matchPacket := re.FindSubmatch(wholePacket)
 					if len(matchPacket) < 2 {
-						return nil, fmt.Errorf("DONTPANIC")
+						return nil, errNoPacket
 					} else {
 						return matchPacket[1], nil // only return the text between tags
 					}
@@ -81,30 +90,65 @@ func (s SerialReader) ReadDevice() ([]byte, error) {
 	}
 }
 
-func DoForwardData(appDlCh, appUlCh, crossCh chan []byte, device string) {
-	siface := &serial.Config{Name: device, Baud: 57600}
-	serReader, err := serial.OpenPort(siface)
+// read NFC packets until the device fails or done is closed
+func readPackets(ser SerialReader, serCh chan<- []byte, errCh chan<- error, done <-chan bool) {
+	for {
+		payload, err := ser.ReadDevice()
+		if err == errNoPacket {
+			continue
+		}
+		if err != nil {
+			select {
+			case errCh <- err:
+			case <-done:
+			}
+			return
+		}
+
+		select {
+		case serCh <- payload:
+		case <-done:
+			return
+		}
+	}
+}
+
+// Forwarder reads NFC data from a real node on the serial device of the app
+// and hands it to its node
+type Forwarder struct{}
+
+func (f *Forwarder) Start(ctx context.Context, node NodeContext) error {
+	device := node.Device()
+	serReader, err := serialport.Open(device)
 	if err != nil {
-		fmt.Println("error opening serial interface:", err.Error())
-		os.Exit(1)
+		return fmt.Errorf("error opening serial interface %s: %v", device.Name, err)
 	}
 	defer serReader.Close()
-	ser := SerialReader{serReader}
-	serCh := devreader.MakeChannel(ser)
+
+	serCh, errCh, done := make(chan []byte), make(chan error), make(chan bool)
+	defer close(done)
+	go readPackets(SerialReader{serReader}, serCh, errCh, done)
 
 LOOP:
 	for {
 		select {
-		case payload := <-serCh:
-			crossCh <- payload
-			fmt.Printf("read nfc data\n- ascii: %s\n- hex: %x\n", string(payload), string(payload))
+		case err := <-errCh:
+			return fmt.Errorf("error reading serial interface %s: %v", device.Name, err)
 
-		case _, more := <-appDlCh:
-			if !more {
-				close(appUlCh)
+		case payload := <-serCh:
+			if err := node.SetNFCData(payload); err != nil {
 				break LOOP
 			}
+			fmt.Printf("read nfc data from %s\n- ascii: %s\n- hex: %x\n", device.Name, string(payload), string(payload))
+
+		case <-ctx.Done():
+			break LOOP
 		}
 	}
-	fmt.Println("stopped forwarding nfc data")
+	fmt.Println("stopped forwarding nfc data from", device.Name)
+	return nil
+}
+
+func (f *Forwarder) OnDownlink(payload []byte) {
+	fmt.Println("forward app received downlink:", hex.EncodeToString(payload))
 }
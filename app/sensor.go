@@ -1,29 +1,142 @@
 package app
 
 import (
+	"context"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
-	"math/rand"
+	"github.com/herrfz/coordnode/clock"
+	"github.com/herrfz/coordnode/rng"
+	"os"
+	"strings"
 	"time"
 )
 
-func DoSendData(appDlCh, appUlCh, crossCh chan []byte, device string) {
-	sPayload := "a001000008ad000017700000000000000000c6e0" // cf. AED temperature test app
-	payload, _ := hex.DecodeString(sPayload)
+func init() {
+	Register("sensor", func(params json.RawMessage) (App, error) { return NewSensor(params) })
+}
+
+// params of the sensor app, all optional; the defaults send the fixed
+// message the AED temperature test app was captured with
+type sensorParams struct {
+	Interval    string `json:"interval"` // between messages, e.g. "5s"
+	Temperature struct {
+		Profile string `json:"profile"` // constant, sine, randomwalk or csv
+
+		Value float64 `json:"value"` // constant
+
+		Mean      float64 `json:"mean"` // sine
+		Amplitude float64 `json:"amplitude"`
+		Period    string  `json:"period"`
+		Peak      string  `json:"peak"` // time of the maximum into the period
+
+		Start float64 `json:"start"` // randomwalk
+		Step  float64 `json:"step"`
+		Min   float64 `json:"min"`
+		Max   float64 `json:"max"`
+
+		File string `json:"file"` // csv of seconds and °C
+	} `json:"temperature"`
+	Battery Battery `json:"battery"`
+}
+
+// NewSensor creates a sensor app from its params, nil for the defaults
+func NewSensor(params json.RawMessage) (*Sensor, error) {
+	p := sensorParams{Interval: "5s"}
+	p.Temperature.Profile = "constant"
+	p.Temperature.Value = 22.21
+	p.Temperature.Period = "24h"
+	p.Temperature.Peak = "0s"
+	p.Battery = Battery{Start: 6000}
+
+	if len(params) != 0 && string(params) != "null" {
+		dec := json.NewDecoder(strings.NewReader(string(params)))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&p); err != nil {
+			return nil, fmt.Errorf("sensor params: %s", err.Error())
+		}
+	}
+
+	interval, err := time.ParseDuration(p.Interval)
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("sensor params: invalid interval %q", p.Interval)
+	}
+	if p.Battery.Min > p.Battery.Start || p.Battery.Decay < 0 {
+		return nil, fmt.Errorf("sensor params: invalid battery %+v", p.Battery)
+	}
+
+	var profile Profile
+	t := p.Temperature
+	switch t.Profile {
+	case "constant":
+		profile = ConstantProfile{t.Value}
+
+	case "sine":
+		period, err := time.ParseDuration(t.Period)
+		if err != nil || period <= 0 {
+			return nil, fmt.Errorf("sensor params: invalid period %q", t.Period)
+		}
+		peak, err := time.ParseDuration(t.Peak)
+		if err != nil {
+			return nil, fmt.Errorf("sensor params: invalid peak %q", t.Peak)
+		}
+		profile = SineProfile{Mean: t.Mean, Amplitude: t.Amplitude, Period: period, Peak: peak}
+
+	case "randomwalk":
+		if t.Min > t.Max || t.Start < t.Min || t.Start > t.Max {
+			return nil, fmt.Errorf("sensor params: random walk start %v not within %v and %v", t.Start, t.Min, t.Max)
+		}
+		profile = &RandomWalkProfile{Start: t.Start, Step: t.Step, Min: t.Min, Max: t.Max, Rand: rng.New()}
+
+	case "csv":
+		f, err := os.Open(t.File)
+		if err != nil {
+			return nil, fmt.Errorf("sensor params: %s", err.Error())
+		}
+		trace, err := ParseTrace(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("sensor params: %s: %s", t.File, err.Error())
+		}
+		profile = trace
+
+	default:
+		return nil, fmt.Errorf("sensor params: unknown temperature profile %q", t.Profile)
+	}
+
+	return &Sensor{Interval: interval, Generator: &AEDGenerator{Temperature: profile, Battery: p.Battery}}, nil
+}
+
+// Sensor sends the data of the AED temperature test app
+type Sensor struct {
+	Interval  time.Duration
+	Generator *AEDGenerator
+}
+
+func (s *Sensor) Start(ctx context.Context, node NodeContext) error {
+	start := clock.Now()
 
 LOOP:
 	for {
 		select {
-		case <-time.Tick(time.Duration(rand.Intn(5)) + 5*1000*time.Millisecond): // add 5ms jitter
-			appUlCh <- payload
-			fmt.Println("sent sensor data:", sPayload)
-
-		case _, more := <-appDlCh:
-			if !more {
-				close(appUlCh)
+		case <-clock.After(s.Interval + time.Duration(node.Rand().Intn(5))*time.Millisecond): // add 5ms jitter
+			payload := s.Generator.Payload(clock.Since(start))
+			if mv := node.BatteryVoltage(); mv > 0 {
+				SetAEDVoltage(payload, mv) // the battery of the node replaces the configured one
+			}
+			if err := node.SendUplink(payload); err != nil {
 				break LOOP
 			}
+			fmt.Println("sent sensor data:", hex.EncodeToString(payload))
+
+		case <-ctx.Done():
+			break LOOP
 		}
 	}
 	fmt.Println("stopped sending sensor data")
+	return nil
+}
+
+func (s *Sensor) OnDownlink(payload []byte) {
+	fmt.Println("sensor app received downlink:", hex.EncodeToString(payload))
 }
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"context"
+	"github.com/herrfz/coordnode/clock"
+	"github.com/herrfz/coordnode/rng"
+	"github.com/herrfz/coordnode/serialport"
+	"testing"
+	"time"
+)
+
+// node of the app under test, its uplinks are sent on a channel
+type testNode struct {
+	uplinks chan []byte
+}
+
+func (n testNode) Node() NodeInfo               { return NodeInfo{} }
+func (n testNode) Keys() Keys                   { return Keys{} }
+func (n testNode) Device() serialport.Config    { return serialport.Config{} }
+func (n testNode) EnergyDetect() byte           { return 0 }
+func (n testNode) LinkCounters() LinkCounters   { return LinkCounters{} }
+func (n testNode) BatteryVoltage() float64      { return 0 }
+func (n testNode) Rand() *rng.Rand              { return nil }
+func (n testNode) SendUplink(p []byte) error    { n.uplinks <- p; return nil }
+func (n testNode) SetNFCData(data []byte) error { return nil }
+
+func TestSensorVirtualTime(t *testing.T) {
+	v := clock.NewVirtual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	clock.Set(v)
+	defer clock.Set(clock.Real)
+
+	s, _ := NewSensor([]byte(`{"interval": "1h"}`))
+	node := testNode{make(chan []byte)}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan bool)
+	go func() {
+		s.Start(ctx, node)
+		close(done)
+	}()
+
+	// a day of data at once
+	started := time.Now()
+	var payload []byte
+	for i := 0; i < 24; i++ {
+		payload = <-node.uplinks
+	}
+	cancel()
+	<-done
+	if d := time.Since(started); d > 5*time.Second {
+		t.Errorf("took %v of wall time", d)
+	}
+	if seq := payload[1]; seq != 24 {
+		t.Errorf("wrong output: %v, expected: 24", seq)
+	}
+}
@@ -0,0 +1,83 @@
+// Package clock gives the emulator its time: the wall clock, or a virtual
+// clock running scenarios as fast as possible
+package clock
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+type Clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+	After(d time.Duration) <-chan time.Time
+	NewTimer(d time.Duration) *Timer
+	NewTicker(d time.Duration) *Ticker
+}
+
+// Timer sends the time on C once, unless stopped before
+type Timer struct {
+	C    <-chan time.Time
+	stop func() bool
+}
+
+// false if the timer already fired or was stopped
+func (t *Timer) Stop() bool {
+	return t.stop()
+}
+
+// Ticker sends the time on C every period, dropping the ticks not received
+type Ticker struct {
+	C    <-chan time.Time
+	stop func() bool
+}
+
+func (t *Ticker) Stop() {
+	t.stop()
+}
+
+// the wall clock
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (realClock) NewTimer(d time.Duration) *Timer {
+	t := time.NewTimer(d)
+	return &Timer{C: t.C, stop: t.Stop}
+}
+
+func (realClock) NewTicker(d time.Duration) *Ticker {
+	t := time.NewTicker(d)
+	return &Ticker{C: t.C, stop: func() bool { t.Stop(); return true }}
+}
+
+// clock of the emulator, set before it starts
+type holder struct{ Clock }
+
+var current atomic.Value
+
+func init() {
+	current.Store(holder{Real})
+}
+
+func Set(c Clock) {
+	current.Store(holder{c})
+}
+
+func Get() Clock {
+	return current.Load().(holder).Clock
+}
+
+// the time package functions on the clock of the emulator
+
+func Now() time.Time                         { return Get().Now() }
+func Since(t time.Time) time.Duration        { return Get().Now().Sub(t) }
+func Until(t time.Time) time.Duration        { return t.Sub(Get().Now()) }
+func Sleep(d time.Duration)                  { Get().Sleep(d) }
+func After(d time.Duration) <-chan time.Time { return Get().After(d) }
+func NewTimer(d time.Duration) *Timer        { return Get().NewTimer(d) }
+func NewTicker(d time.Duration) *Ticker      { return Get().NewTicker(d) }
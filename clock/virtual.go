@@ -0,0 +1,166 @@
+package clock
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// default quiet wall time before the next event
+const SETTLE = time.Millisecond
+
+// Virtual is a discrete-event clock: its time stands still while the emulator
+// works and jumps to the next timer once it has been quiet, i.e. did not use
+// the clock, for Settle of wall time. Timers fire one at a time in the order
+// of their time, and of their creation for the same time, so that what one
+// event causes is scheduled before the next fires; work running longer than
+// Settle without using the clock may be overtaken by later events
+type Virtual struct {
+	Settle time.Duration
+
+	mutex   sync.Mutex
+	now     time.Time
+	events  events
+	seq     uint64
+	touched time.Time // wall time of the last use
+	wake    chan bool
+}
+
+type event struct {
+	when   time.Time
+	seq    uint64
+	c      chan time.Time
+	period time.Duration // ticker, 0 for a timer
+	index  int           // in the heap, -1 if not scheduled
+}
+
+// events by time, then by creation
+type events []*event
+
+func (h events) Len() int { return len(h) }
+func (h events) Less(i, j int) bool {
+	if h[i].when.Equal(h[j].when) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].when.Before(h[j].when)
+}
+func (h events) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+func (h *events) Push(x interface{}) {
+	e := x.(*event)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+func (h *events) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h, e.index = old[:len(old)-1], -1
+	return e
+}
+
+// virtual clock at a start time, running until the process exits
+func NewVirtual(start time.Time) *Virtual {
+	v := &Virtual{Settle: SETTLE, now: start, touched: time.Now(), wake: make(chan bool, 1)}
+	go v.run()
+	return v
+}
+
+// fire the next event once the emulator is quiet
+func (v *Virtual) run() {
+	for {
+		v.mutex.Lock()
+		if len(v.events) == 0 {
+			v.mutex.Unlock()
+			<-v.wake
+			continue
+		}
+		if quiet := time.Since(v.touched); quiet < v.Settle {
+			v.mutex.Unlock()
+			time.Sleep(v.Settle - quiet)
+			continue
+		}
+
+		e := heap.Pop(&v.events).(*event)
+		if e.when.After(v.now) {
+			v.now = e.when
+		}
+		if e.period > 0 {
+			e.when = e.when.Add(e.period)
+			v.schedule(e)
+		}
+		v.touched = time.Now()
+		now := v.now
+		v.mutex.Unlock()
+
+		select {
+		case e.c <- now:
+		default: // not received yet, as time.Ticker
+		}
+	}
+}
+
+// call with the mutex held
+func (v *Virtual) schedule(e *event) {
+	v.seq++
+	e.seq = v.seq
+	heap.Push(&v.events, e)
+	select {
+	case v.wake <- true:
+	default:
+	}
+}
+
+// call with the mutex held
+func (v *Virtual) touch() {
+	v.touched = time.Now()
+}
+
+func (v *Virtual) add(d, period time.Duration) *event {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.touch()
+	e := &event{when: v.now.Add(d), c: make(chan time.Time, 1), period: period, index: -1}
+	v.schedule(e)
+	return e
+}
+
+func (v *Virtual) remove(e *event) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.touch()
+	if e.index < 0 {
+		return false
+	}
+	heap.Remove(&v.events, e.index)
+	return true
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.touch()
+	return v.now
+}
+
+func (v *Virtual) Sleep(d time.Duration) {
+	<-v.After(d)
+}
+
+func (v *Virtual) After(d time.Duration) <-chan time.Time {
+	return v.add(d, 0).c
+}
+
+func (v *Virtual) NewTimer(d time.Duration) *Timer {
+	e := v.add(d, 0)
+	return &Timer{C: e.c, stop: func() bool { return v.remove(e) }}
+}
+
+func (v *Virtual) NewTicker(d time.Duration) *Ticker {
+	if d <= 0 {
+		panic("clock: non-positive interval for NewTicker")
+	}
+	e := v.add(d, d)
+	return &Ticker{C: e.c, stop: func() bool { return v.remove(e) }}
+}
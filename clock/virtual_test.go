@@ -0,0 +1,61 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func TestVirtualSleep(t *testing.T) {
+	v := NewVirtual(epoch)
+	started := time.Now()
+	v.Sleep(24 * time.Hour)
+	if now := v.Now(); !now.Equal(epoch.Add(24 * time.Hour)) {
+		t.Errorf("wrong output: %v, expected: %v", now, epoch.Add(24*time.Hour))
+	}
+	if d := time.Since(started); d > time.Second {
+		t.Errorf("slept %v of wall time", d)
+	}
+}
+
+func TestVirtualOrder(t *testing.T) {
+	v := NewVirtual(epoch)
+	fired := make(chan string, 10)
+
+	// what the first event causes happens before the later events
+	go func() {
+		v.Sleep(time.Hour)
+		fired <- "a"
+		<-v.After(time.Minute)
+		fired <- "c"
+	}()
+	go func() {
+		v.Sleep(time.Hour + 30*time.Second)
+		fired <- "b"
+	}()
+	timer := v.NewTimer(time.Hour + 10*time.Second)
+	ticker := v.NewTicker(25 * time.Minute)
+
+	got := ""
+	for len(got) < 5 {
+		select {
+		case s := <-fired:
+			got += s
+		case <-ticker.C:
+			got += "t"
+		case <-timer.C:
+			t.Errorf("stopped timer fired")
+		}
+		if got == "tt" && !timer.Stop() {
+			t.Errorf("timer not stopped")
+		}
+	}
+	ticker.Stop()
+	if got != "ttabc" {
+		t.Errorf("wrong output: %v, expected: ttabc", got)
+	}
+	if timer.Stop() {
+		t.Errorf("timer stopped twice")
+	}
+}
@@ -0,0 +1,66 @@
+// nodesim emulates the firmware of a real node on a serial device or one end
+// of a pseudo-terminal pair, to test coordnode -nodeSerial without hardware
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/herrfz/coordnode/config"
+	"github.com/herrfz/coordnode/transport"
+	"github.com/herrfz/coordnode/worker"
+	"os"
+	"os/signal"
+)
+
+func main() {
+	device := flag.String("device", "", "link the node is connected to: serial device (device[?baud=N&parity=N&stop=1&timeout=D]), tcp://host:port, unix:///path, pty://[/file], ...")
+	caps := flag.Int("caps", worker.CAP_SEQ|worker.CAP_CRC16|worker.CAP_LONG_LEN, "capabilities accepted in the hello, 0 for legacy firmware")
+	scriptFile := flag.String("script", "", "script of messages the node sends after the handshake")
+	flag.Parse()
+
+	if *device == "" {
+		fmt.Println("link to the coordinator is not provided")
+		os.Exit(1)
+	}
+	link, err := transport.Parse(*device, config.NodePort)
+	if err != nil {
+		fmt.Println("invalid link:", err.Error())
+		os.Exit(1)
+	}
+
+	sim := worker.NodeSim{Caps: byte(*caps)}
+	if *scriptFile != "" {
+		f, err := os.Open(*scriptFile)
+		if err != nil {
+			fmt.Println("error opening script:", err.Error())
+			os.Exit(1)
+		}
+		sim.Script, err = worker.ParseSimScript(f)
+		f.Close()
+		if err != nil {
+			fmt.Println("error parsing script:", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	s, err := link.Open()
+	if err != nil {
+		fmt.Println("error opening", link.String()+":", err.Error())
+		os.Exit(1)
+	}
+	defer s.Close()
+
+	intrCh := make(chan os.Signal, 1)
+	signal.Notify(intrCh, os.Interrupt)
+	stop := make(chan bool)
+	go func() {
+		<-intrCh
+		close(stop)
+	}()
+
+	fmt.Println("node simulator on", link.String())
+	if err := sim.Run(s, stop); err != nil {
+		fmt.Println("error on", link.String()+":", err.Error())
+	}
+	fmt.Println("node simulator stopped")
+}
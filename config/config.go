@@ -0,0 +1,550 @@
+// This package loads the emulator scenario, i.e. the coordinator and the
+// emulated nodes, from a JSON file
+package config
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/herrfz/coordnode/serialport"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// app types known to the emulator, the main program sets the registered apps
+var AppTypes = []string{"jamming", "sensor", "forward"}
+
+// security modes: no security processing, authenticated uplinks, or
+// authenticated and encrypted uplinks
+var SecurityModes = []string{"none", "auth", "enc"}
+
+// byte string given as hex in the file, optionally separated by ':'
+type HexBytes []byte
+
+func (b *HexBytes) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("expected hex string")
+	}
+	buf, err := hex.DecodeString(strings.Replace(s, ":", "", -1))
+	if err != nil {
+		return fmt.Errorf("invalid hex string %q", s)
+	}
+	*b = buf
+	return nil
+}
+
+type Serial struct {
+	Device      string  `json:"device"`
+	Baud        int     `json:"baud"`
+	Parity      string  `json:"parity"`      // N, E or O
+	StopBits    float64 `json:"stopBits"`    // 1 or 2
+	ReadTimeout string  `json:"readTimeout"` // e.g. "100ms", blocking reads if not given
+}
+
+// port settings, parameters not given are taken from the default
+func (s Serial) Port(def serialport.Config) (serialport.Config, error) {
+	var err error
+	c := def
+	c.Name = s.Device
+	if s.Baud != 0 {
+		c.Baud = s.Baud
+	}
+	if s.Parity != "" {
+		if c.Parity, err = serialport.ParseParity(s.Parity); err != nil {
+			return c, fmt.Errorf("parity: %s", err.Error())
+		}
+	}
+	if s.StopBits != 0 {
+		if c.StopBits, err = serialport.ParseStopBits(strconv.FormatFloat(s.StopBits, 'f', -1, 64)); err != nil {
+			return c, fmt.Errorf("stopBits: %s", err.Error())
+		}
+	}
+	if s.ReadTimeout != "" {
+		if c.ReadTimeout, err = time.ParseDuration(s.ReadTimeout); err != nil {
+			return c, fmt.Errorf("readTimeout: %s", err.Error())
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return c, err
+	}
+	return c, nil
+}
+
+// default settings of the serial ports
+var (
+	WDCPort     = serialport.Default("", 57600)
+	NodePort    = serialport.Default("", 9600)
+	ForwardPort = serialport.Default("", 57600)
+)
+
+type Coordinator struct {
+	PAN      HexBytes `json:"pan"`      // frame byte order, e.g. "b1ca"
+	LongAddr HexBytes `json:"longAddr"` // EUI-64
+	Serial   Serial   `json:"serial"`
+}
+
+type App struct {
+	Type   string          `json:"type"`
+	Params json.RawMessage `json:"params"`
+}
+
+// parameters of the forward app
+type ForwardParams struct {
+	Serial
+}
+
+type Link struct {
+	LQI      int       `json:"lqi"`
+	ED       int       `json:"ed"`
+	Loss     float64   `json:"loss"`     // probability of losing an uplink
+	Position []float64 `json:"position"` // x, y, z in metres, for jamming and propagation
+	Slot     int       `json:"slot"`     // time slot of the uplinks, for slot-targeted jamming and TDMA
+	Ack      Ack       `json:"ack"`
+	Power    float64   `json:"power"`    // dBm, for propagation
+	Mobility string    `json:"mobility"` // CSV trace of seconds, x, y, z replacing the position, for propagation
+}
+
+// spatial propagation: if given, the LQI and ED of the nodes follow from their
+// positions instead of link.lqi and link.ed
+type Radio struct {
+	Coordinator []float64 `json:"coordinator"` // x, y, z in metres
+	RefLoss     *float64  `json:"refLoss"`     // dB at refDistance, free space if not given
+	RefDistance float64   `json:"refDistance"` // m, 1 if not given
+	Exponent    float64   `json:"exponent"`    // 2 if not given
+	Shadowing   float64   `json:"shadowing"`   // standard deviation in dB
+	Walls       []Wall    `json:"walls"`
+}
+
+// air shared by the uplinks of the nodes, which collide if they overlap; while
+// the wdc runs TDMA they wait for the slot of their node
+type Channel struct {
+	Slot  string `json:"slot"`  // length of a TDMA slot, e.g. "10ms", uplinks always contend if not given
+	Slots int    `json:"slots"` // per TDMA cycle
+}
+
+// length of a TDMA slot, 0 if not given
+func (c Channel) SlotLength() (time.Duration, error) {
+	if c.Slot == "" {
+		return 0, nil
+	}
+	d, err := time.ParseDuration(c.Slot)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("slot: invalid duration %q", c.Slot)
+	}
+	return d, nil
+}
+
+// wall of the floor plan, over all heights
+type Wall struct {
+	From        []float64 `json:"from"` // x, y in metres
+	To          []float64 `json:"to"`
+	Attenuation float64   `json:"attenuation"` // dB
+}
+
+// MAC acknowledgements, of downlinks if the wdc requests them and of uplinks
+// if Uplink is set
+type Ack struct {
+	Uplink  bool    `json:"uplink"`
+	Loss    float64 `json:"loss"`    // probability of losing an acknowledgement
+	Retries *int    `json:"retries"` // retransmissions of a frame not acknowledged, 3 if not given
+	Backoff string  `json:"backoff"` // longest wait before the first retransmission, e.g. "10ms"
+}
+
+// transmitter interfering with the nodes
+type Jammer struct {
+	Position []float64 `json:"position"` // x, y, z in metres
+	Power    float64   `json:"power"`    // dBm
+	Start    string    `json:"start"`    // after the emulator starts, e.g. "30s", at once if not given
+	Stop     string    `json:"stop"`     // after the emulator starts, never if not given
+	Slots    []int     `json:"slots"`    // targeted slots, the whole channel if not given
+	Corrupt  float64   `json:"corrupt"`  // share of the jammed uplinks received with bit errors instead of lost
+}
+
+// start and stop of the jammer, stop 0 for never
+func (j Jammer) Schedule() (start, stop time.Duration, err error) {
+	if j.Start != "" {
+		if start, err = time.ParseDuration(j.Start); err != nil || start < 0 {
+			return 0, 0, fmt.Errorf("start: invalid duration %q", j.Start)
+		}
+	}
+	if j.Stop != "" {
+		if stop, err = time.ParseDuration(j.Stop); err != nil || stop <= start {
+			return 0, 0, fmt.Errorf("stop: invalid duration %q, must be after start", j.Stop)
+		}
+	}
+	return start, stop, nil
+}
+
+// pre-provisioned keys, empty keys are established over the air
+type Keys struct {
+	NIK HexBytes `json:"nik"`
+	S   HexBytes `json:"s"`
+	AK  HexBytes `json:"ak"`
+	SIK HexBytes `json:"sik"`
+	SCK HexBytes `json:"sck"`
+}
+
+type Node struct {
+	Address  int      `json:"address"`
+	EUI64    HexBytes `json:"eui64"` // generated from the OUI if not given
+	App      App      `json:"app"`
+	Security string   `json:"security"`
+	Link     Link     `json:"link"`
+	Keys     Keys     `json:"keys"`
+	Sleep    *Sleep   `json:"sleep"`   // always on if not given
+	Battery  *Battery `json:"battery"` // never depleted if not given
+}
+
+// energy model of a node; parameters not given take the defaults of the
+// energy package
+type Battery struct {
+	Capacity float64            `json:"capacity"` // mAh
+	Full     float64            `json:"full"`     // mV
+	Empty    float64            `json:"empty"`    // mV, the node dies there
+	Costs    map[string]float64 `json:"costs"`    // µJ per byte or operation, µW: one of BatteryCosts
+}
+
+var BatteryCosts = []string{"tx", "rx", "ecdh", "aes", "hmac", "sleep", "listen"}
+
+// sleepy node, polling the coordinator for its downlinks
+type Sleep struct {
+	Poll        string `json:"poll"`        // between wake ups, e.g. "5s"
+	Persistence string `json:"persistence"` // queued downlinks expire after, 7.68s if not given
+}
+
+// poll interval and persistence time, 0 if not given
+func (s Sleep) Durations() (poll, persistence time.Duration, err error) {
+	if poll, err = time.ParseDuration(s.Poll); err != nil || poll <= 0 {
+		return 0, 0, fmt.Errorf("poll: invalid duration %q", s.Poll)
+	}
+	if s.Persistence != "" {
+		if persistence, err = time.ParseDuration(s.Persistence); err != nil || persistence <= 0 {
+			return 0, 0, fmt.Errorf("persistence: invalid duration %q", s.Persistence)
+		}
+	}
+	return poll, persistence, nil
+}
+
+// real node connected through a serial interface
+type Passthrough struct {
+	Serial
+	Address *int `json:"address"` // all requests not sent to an emulated node if not given
+}
+
+type Config struct {
+	Coordinator Coordinator  `json:"coordinator"`
+	Nodes       []Node       `json:"nodes"`
+	Passthrough *Passthrough `json:"passthrough"`
+	Jammers     []Jammer     `json:"jammers"`
+	Radio       *Radio       `json:"radio"`
+	Channel     *Channel     `json:"channel"`
+}
+
+// read, parse and validate a scenario file
+func Load(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg := &Config{}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(cfg); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return cfg, nil
+}
+
+func (cfg *Config) Validate() error {
+	c := cfg.Coordinator
+	if c.PAN != nil && len(c.PAN) != 2 {
+		return fmt.Errorf("coordinator.pan: must be 2 bytes, got %d", len(c.PAN))
+	}
+	if c.LongAddr != nil && len(c.LongAddr) != 8 {
+		return fmt.Errorf("coordinator.longAddr: must be 8 bytes, got %d", len(c.LongAddr))
+	}
+	if c.Serial.Device != "" {
+		if _, err := c.Serial.Port(WDCPort); err != nil {
+			return fmt.Errorf("coordinator.serial: %s", err.Error())
+		}
+	}
+
+	if len(cfg.Nodes) == 0 && cfg.Passthrough == nil {
+		return fmt.Errorf("nodes: no nodes configured")
+	}
+
+	addrs := make(map[int]int)
+	euis := make(map[string]int)
+	devices := make(map[string]int)
+	for i := range cfg.Nodes {
+		n := &cfg.Nodes[i]
+		if err := n.validate(); err != nil {
+			return fmt.Errorf("nodes[%d]: %s", i, err.Error())
+		}
+
+		if j, ok := addrs[n.Address]; ok {
+			return fmt.Errorf("nodes[%d]: address %d already used by nodes[%d]", i, n.Address, j)
+		}
+		addrs[n.Address] = i
+
+		if n.EUI64 != nil { // the generated ones depend on the OUI, checked when the nodes are made
+			eui := hex.EncodeToString(n.EUI64)
+			if j, ok := euis[eui]; ok {
+				return fmt.Errorf("nodes[%d]: eui64 %s already used by nodes[%d]", i, eui, j)
+			}
+			euis[eui] = i
+		}
+
+		if n.Link.Mobility != "" && cfg.Radio == nil {
+			return fmt.Errorf("nodes[%d]: link.mobility: needs a radio section", i)
+		}
+
+		if n.App.Type == "forward" {
+			p, _ := n.App.ForwardParams()
+			if j, ok := devices[p.Device]; ok {
+				return fmt.Errorf("nodes[%d]: forward device %s already used by nodes[%d]", i, p.Device, j)
+			}
+			devices[p.Device] = i
+		}
+	}
+
+	for i, j := range cfg.Jammers {
+		if err := j.validate(); err != nil {
+			return fmt.Errorf("jammers[%d]: %s", i, err.Error())
+		}
+	}
+
+	if r := cfg.Radio; r != nil {
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("radio.%s", err.Error())
+		}
+	}
+
+	if c := cfg.Channel; c != nil {
+		d, err := c.SlotLength()
+		if err != nil {
+			return fmt.Errorf("channel.%s", err.Error())
+		}
+		if d > 0 {
+			if c.Slots < 1 || c.Slots > 256 {
+				return fmt.Errorf("channel.slots: %d out of range 1..256", c.Slots)
+			}
+			for i, n := range cfg.Nodes {
+				if n.Link.Slot >= c.Slots {
+					return fmt.Errorf("nodes[%d]: link.slot: %d beyond the %d slots of the channel", i, n.Link.Slot, c.Slots)
+				}
+			}
+		}
+	}
+
+	if p := cfg.Passthrough; p != nil {
+		if _, err := p.Port(NodePort); err != nil {
+			return fmt.Errorf("passthrough: %s", err.Error())
+		}
+		if j, ok := devices[p.Device]; ok {
+			return fmt.Errorf("passthrough.device: %s already used by nodes[%d]", p.Device, j)
+		}
+		if p.Address != nil {
+			if *p.Address < 0 || *p.Address >= 0xfffe {
+				return fmt.Errorf("passthrough.address: %d out of range 0..65533", *p.Address)
+			}
+			if j, ok := addrs[*p.Address]; ok {
+				return fmt.Errorf("passthrough.address: %d already used by nodes[%d]", *p.Address, j)
+			}
+		}
+	}
+	return nil
+}
+
+func (n *Node) validate() error {
+	if n.Address < 0 || n.Address >= 0xfffe { // 0xfffe and 0xffff are reserved
+		return fmt.Errorf("address: %d out of range 0..65533", n.Address)
+	}
+	if n.EUI64 != nil && len(n.EUI64) != 8 {
+		return fmt.Errorf("eui64: must be 8 bytes, got %d", len(n.EUI64))
+	}
+
+	if n.Security == "" {
+		n.Security = "auth"
+	}
+	if !contains(SecurityModes, n.Security) {
+		return fmt.Errorf("security: unknown mode %q, expected one of %s",
+			n.Security, strings.Join(SecurityModes, ", "))
+	}
+
+	if err := n.App.validate(); err != nil {
+		return fmt.Errorf("app: %s", err.Error())
+	}
+
+	if n.Link.LQI < 0 || n.Link.LQI > 255 {
+		return fmt.Errorf("link.lqi: %d out of range 0..255", n.Link.LQI)
+	}
+	if n.Link.ED < 0 || n.Link.ED > 255 {
+		return fmt.Errorf("link.ed: %d out of range 0..255", n.Link.ED)
+	}
+	if n.Link.Loss < 0 || n.Link.Loss > 1 {
+		return fmt.Errorf("link.loss: %v out of range 0..1", n.Link.Loss)
+	}
+	if n.Link.Position != nil && len(n.Link.Position) != 3 {
+		return fmt.Errorf("link.position: expected x, y and z, got %d values", len(n.Link.Position))
+	}
+	if n.Link.Slot < 0 || n.Link.Slot > 255 {
+		return fmt.Errorf("link.slot: %d out of range 0..255", n.Link.Slot)
+	}
+	if a := n.Link.Ack; a.Loss < 0 || a.Loss > 1 {
+		return fmt.Errorf("link.ack.loss: %v out of range 0..1", a.Loss)
+	}
+	if r := n.Link.Ack.Retries; r != nil && (*r < 0 || *r > 7) {
+		return fmt.Errorf("link.ack.retries: %d out of range 0..7", *r)
+	}
+	if b := n.Link.Ack.Backoff; b != "" {
+		if d, err := time.ParseDuration(b); err != nil || d < 0 {
+			return fmt.Errorf("link.ack.backoff: invalid duration %q", b)
+		}
+	}
+
+	if n.Sleep != nil {
+		if _, _, err := n.Sleep.Durations(); err != nil {
+			return fmt.Errorf("sleep.%s", err.Error())
+		}
+	}
+	if b := n.Battery; b != nil {
+		if b.Capacity < 0 || b.Full < 0 || b.Empty < 0 {
+			return fmt.Errorf("battery: negative capacity or voltage")
+		}
+		if b.Full != 0 && b.Empty != 0 && b.Empty >= b.Full {
+			return fmt.Errorf("battery: empty %vmV not below full %vmV", b.Empty, b.Full)
+		}
+		for name, cost := range b.Costs {
+			if !contains(BatteryCosts, name) {
+				return fmt.Errorf("battery.costs: unknown cost %q, expected one of %s", name, strings.Join(BatteryCosts, ", "))
+			}
+			if cost < 0 {
+				return fmt.Errorf("battery.costs.%s: negative cost %v", name, cost)
+			}
+		}
+	}
+
+	keys := []struct {
+		name string
+		key  HexBytes
+	}{{"nik", n.Keys.NIK}, {"s", n.Keys.S}, {"ak", n.Keys.AK}, {"sik", n.Keys.SIK}, {"sck", n.Keys.SCK}}
+	for _, k := range keys {
+		if k.key != nil && len(k.key) != 16 {
+			return fmt.Errorf("keys.%s: must be 16 bytes, got %d", k.name, len(k.key))
+		}
+	}
+	if (n.Keys.SIK == nil) != (n.Keys.SCK == nil) {
+		return fmt.Errorf("keys: sik and sck must be given together")
+	}
+	if (n.Keys.S == nil) != (n.Keys.AK == nil) {
+		return fmt.Errorf("keys: s and ak must be given together")
+	}
+	return nil
+}
+
+func (r *Radio) validate() error {
+	if r.Coordinator != nil && len(r.Coordinator) != 3 {
+		return fmt.Errorf("coordinator: expected x, y and z, got %d values", len(r.Coordinator))
+	}
+	if r.RefDistance < 0 {
+		return fmt.Errorf("refDistance: negative distance %v", r.RefDistance)
+	}
+	if r.Exponent < 0 {
+		return fmt.Errorf("exponent: negative exponent %v", r.Exponent)
+	}
+	if r.Shadowing < 0 {
+		return fmt.Errorf("shadowing: negative deviation %v", r.Shadowing)
+	}
+	for i, w := range r.Walls {
+		if len(w.From) != 2 || len(w.To) != 2 {
+			return fmt.Errorf("walls[%d]: expected x and y for from and to", i)
+		}
+		if w.Attenuation < 0 {
+			return fmt.Errorf("walls[%d].attenuation: negative attenuation %v", i, w.Attenuation)
+		}
+	}
+	return nil
+}
+
+func (j *Jammer) validate() error {
+	if len(j.Position) != 3 {
+		return fmt.Errorf("position: expected x, y and z, got %d values", len(j.Position))
+	}
+	if _, _, err := j.Schedule(); err != nil {
+		return err
+	}
+	for _, slot := range j.Slots {
+		if slot < 0 || slot > 255 {
+			return fmt.Errorf("slots: %d out of range 0..255", slot)
+		}
+	}
+	if j.Corrupt < 0 || j.Corrupt > 1 {
+		return fmt.Errorf("corrupt: %v out of range 0..1", j.Corrupt)
+	}
+	return nil
+}
+
+func (a *App) validate() error {
+	if !contains(AppTypes, a.Type) {
+		return fmt.Errorf("type: unknown app %q, expected one of %s", a.Type, strings.Join(AppTypes, ", "))
+	}
+
+	switch a.Type {
+	case "forward":
+		p, err := a.ForwardParams()
+		if err != nil {
+			return err
+		}
+		if p.Device == "" {
+			return fmt.Errorf("params.device: forward app needs a serial device")
+		}
+		if _, err := p.Port(ForwardPort); err != nil {
+			return fmt.Errorf("params: %s", err.Error())
+		}
+	case "jamming":
+		if len(a.Params) != 0 && string(a.Params) != "null" {
+			return fmt.Errorf("params: %s app takes no parameters", a.Type)
+		}
+	}
+	return nil
+}
+
+func (a *App) ForwardParams() (ForwardParams, error) {
+	p := ForwardParams{}
+	if err := decodeParams(a.Params, &p); err != nil {
+		return p, err
+	}
+	return p, nil
+}
+
+func decodeParams(raw json.RawMessage, v interface{}) error {
+	if len(raw) == 0 {
+		return nil
+	}
+	dec := json.NewDecoder(strings.NewReader(string(raw)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return fmt.Errorf("params: %s", err.Error())
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
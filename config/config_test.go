@@ -0,0 +1,80 @@
+package config
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLoadExample(t *testing.T) {
+	cfg, err := Load("example.json")
+	if err != nil {
+		t.Fatalf("error loading: %v", err.Error())
+	}
+
+	if len(cfg.Nodes) != 3 {
+		t.Fatalf("wrong number of nodes: %v, expected: 3", len(cfg.Nodes))
+	}
+
+	if cfg.Nodes[0].Security != "auth" {
+		t.Errorf("wrong default security mode: %v, expected: auth", cfg.Nodes[0].Security)
+	}
+
+	p, err := cfg.Nodes[2].App.ForwardParams()
+	if err != nil || p.Device != "/dev/ttyUSB1" || p.Baud != 57600 {
+		t.Errorf("wrong forward params: %+v, %v", p, err)
+	}
+}
+
+var invalid = []struct {
+	json, err string
+}{
+	{`{"nodes": []}`, "no nodes"},
+	{`{"coordinator": {"pan": "b1"}, "nodes": [{"app": {"type": "sensor"}}]}`, "coordinator.pan"},
+	{`{"nodes": [{"app": {"type": "toaster"}}]}`, `unknown app "toaster"`},
+	{`{"nodes": [{"app": {"type": "forward"}}]}`, "params.device"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "security": "maybe"}]}`, `unknown mode "maybe"`},
+	{`{"nodes": [{"app": {"type": "sensor"}, "link": {"loss": 2}}]}`, "link.loss"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "keys": {"sik": "00"}}]}`, "keys.sik"},
+	{`{"nodes": [{"app": {"type": "sensor"}}, {"app": {"type": "sensor"}}]}`, "already used by nodes[0]"},
+	{`{"nodes": [{"address": 65535, "app": {"type": "sensor"}}]}`, "out of range"},
+	{`{"nodes": [{"app": {"type": "forward", "params": {"device": "/dev/ttyUSB1"}}},
+		{"address": 1, "app": {"type": "forward", "params": {"device": "/dev/ttyUSB1"}}}]}`, "forward device /dev/ttyUSB1 already used"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "passthrough": {"device": "/dev/ttyACM0", "address": 0}}`, "passthrough.address"},
+	{`{"coordinator": {"serial": {"device": "/dev/ttyUSB0", "baud": 1234}}, "nodes": [{"app": {"type": "sensor"}}]}`, "unsupported baud rate"},
+	{`{"nodes": [{"app": {"type": "forward", "params": {"device": "/dev/ttyUSB1", "parity": "X"}}}]}`, "parity"},
+	{`{"nodes": [], "passthrough": {"device": "/dev/ttyACM0", "readTimeout": "soon"}}`, "passthrough: readTimeout"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "link": {"position": [1, 2]}}]}`, "link.position"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "link": {"ack": {"retries": 8}}}]}`, "link.ack.retries"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "link": {"ack": {"backoff": "later"}}}]}`, "link.ack.backoff"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "sleep": {}}]}`, "sleep.poll"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "battery": {"full": 2000, "empty": 3000}}]}`, "battery: empty"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "battery": {"costs": {"lcd": 1}}}]}`, `unknown cost "lcd"`},
+	{`{"nodes": [{"app": {"type": "sensor"}, "sleep": {"poll": "5s", "persistence": "-1s"}}]}`, "sleep.persistence"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "jammers": [{"power": 0}]}`, "jammers[0]: position"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "jammers": [{"position": [0, 0, 0], "start": "1m", "stop": "30s"}]}`, "jammers[0]: stop"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "jammers": [{"position": [0, 0, 0], "corrupt": 1.5}]}`, "jammers[0]: corrupt"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "link": {"mobility": "walk.csv"}}]}`, "needs a radio section"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "radio": {"walls": [{"from": [0, 0, 0], "to": [0, 1]}]}}`, "radio.walls[0]"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "radio": {"shadowing": -4}}`, "radio.shadowing"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "channel": {"slot": "soon"}}`, "channel.slot"},
+	{`{"nodes": [{"app": {"type": "sensor"}}], "channel": {"slot": "10ms"}}`, "channel.slots"},
+	{`{"nodes": [{"app": {"type": "sensor"}, "link": {"slot": 4}}], "channel": {"slot": "10ms", "slots": 4}}`, "beyond the 4 slots"},
+}
+
+func TestValidate(t *testing.T) {
+	for _, test := range invalid {
+		cfg := Config{}
+		if err := json.Unmarshal([]byte(test.json), &cfg); err != nil {
+			t.Errorf("error parsing %v: %v", test.json, err.Error())
+			continue
+		}
+
+		err := cfg.Validate()
+		if err == nil {
+			t.Errorf("no error validating %v", test.json)
+		} else if !strings.Contains(err.Error(), test.err) {
+			t.Errorf("wrong error: %v, expected: %v", err.Error(), test.err)
+		}
+	}
+}
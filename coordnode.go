@@ -2,160 +2,452 @@ package main
 
 import (
 	"bytes"
-	"encoding/binary"
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"github.com/herrfz/coordnode/app"
+	"github.com/herrfz/coordnode/clock"
+	"github.com/herrfz/coordnode/config"
+	"github.com/herrfz/coordnode/rng"
+	"github.com/herrfz/coordnode/serialport"
+	"github.com/herrfz/coordnode/transport"
 	"github.com/herrfz/coordnode/worker"
 	"github.com/herrfz/devreader"
-	"github.com/tarm/goserial"
 	"io"
 	"os"
 	"os/signal"
+	"sort"
 	"sync"
+	"time"
 )
 
-type SerialReader struct {
-	serial io.ReadWriteCloser
+var nodeWdcChannels [](chan []byte)
+var chPool [](chan bool)  // closed when the node is stopped
+var mutex = &sync.Mutex{} // protect uplink serial access to wdc; multiple node goroutines
+
+// data requests handled by a node
+type nodeFilter struct {
+	accept   func(dstAddr []byte) bool
+	indirect bool // the node sleeps, its data requests are confirmed once delivered
 }
 
-// SerialReader defines ReadDevice, means it implements devreader interface
-func (s SerialReader) ReadDevice() ([]byte, error) {
-	buf := make([]byte, 128)
-	msgLen, err := s.serial.Read(buf)
-	if msgLen > 0 && err == nil {
-		return buf[:msgLen], nil
-	} else {
-		return []byte{}, err
+var nodeFilters []nodeFilter // of the nodes on nodeWdcChannels
+
+// delay before restarting a failed node, doubled on every failure in a row
+const (
+	RESTART_MIN = 1 * time.Second
+	RESTART_MAX = 60 * time.Second
+)
+
+// starts the goroutines of a node on fresh channels, each of them reports its
+// result on errCh; returns how many were started
+type nodeStarter func(dlCh, ulCh chan []byte, errCh chan<- error) int
+
+// run one goroutine of a node, a panic is reported like an error
+func runGuarded(errCh chan<- error, f func() error) {
+	go func() {
+		errCh <- func() (err error) {
+			defer func() {
+				if r := recover(); r != nil {
+					err = fmt.Errorf("panic: %v", r)
+				}
+			}()
+			return f()
+		}()
+	}()
+}
+
+// pass data requests accepted by the node to its worker (broadcasts are always
+// accepted), and its indications to the wdc. when nodeWdcCh is closed or one
+// of the node goroutines returns, the node is torn down by closing dlCh;
+// returns once all goroutines are done and ulCh is closed
+func runNode(accept func(dstAddr []byte) bool, nodeWdcCh, dlCh, ulCh chan []byte,
+	errCh <-chan error, running int, wdc io.Writer) (stopped bool, failure error) {
+	var pending []byte // accepted request, not yet taken by the worker
+	stopping := false
+	stop := func() {
+		if !stopping {
+			stopping = true
+			close(dlCh)
+		}
+	}
+
+	for running > 0 || ulCh != nil {
+		var in, out chan []byte
+		if stopping {
+		} else if pending == nil {
+			in = nodeWdcCh
+		} else {
+			out = dlCh
+		}
+
+		select {
+		case wdcReq, more := <-in:
+			if !more {
+				stopped = true
+				stop()
+				continue
+			}
+
+			reqmsg := worker.WDC_REQ{}
+			if err := reqmsg.ParseWDCReq(wdcReq); err != nil {
+				continue
+			}
+			if accept(reqmsg.DSTADDR) || bytes.Equal(reqmsg.DSTADDR, []byte{0xff, 0xff}) { // only process message that is sent to us or broadcast
+				pending = wdcReq
+			}
+
+		case out <- pending:
+			pending = nil
+
+		case nodeInd, more := <-ulCh:
+			if !more {
+				ulCh = nil
+				continue
+			}
+			//mutex.Lock()
+			wdc.Write(nodeInd) // ignore error on wdc serial write
+			//mutex.Unlock()
+			fmt.Println("sent node uplink message")
+
+		case err := <-errCh:
+			running--
+			if err != nil && failure == nil {
+				failure = err
+			}
+			stop()
+		}
 	}
+	return stopped, failure
 }
 
-type node struct {
-	appFunction func(appDlCh, appUlCh, crossCh chan []byte, device string)
-	device      string
+// the node handling data requests to an address, if any
+func handledBy(dstAddr []byte) (nodeFilter, bool) {
+	for _, filter := range nodeFilters {
+		if filter.accept(dstAddr) {
+			return filter, true
+		}
+	}
+	return nodeFilter{}, false
 }
 
-var nodeWdcChannels, chPool [](chan []byte)
-var mutex = &sync.Mutex{} // protect uplink serial access to wdc; multiple node goroutines
+// data requests confirmed by the node instead of at once
+func (f nodeFilter) confirms(req worker.WDC_REQ) bool {
+	return req.ACKREQ || (f.indirect && !req.Broadcast())
+}
+
+// drop the data requests of a node while it is down, those the node would
+// confirm are confirmed as not delivered; false if the node is stopped
+// meanwhile
+func idle(filter nodeFilter, nodeWdcCh chan []byte, d time.Duration, wdc io.Writer) bool {
+	timeout := clock.After(d)
+	for {
+		select {
+		case <-timeout:
+			return true
+		case wdcReq, more := <-nodeWdcCh:
+			if !more {
+				return false
+			}
+			reqmsg := worker.WDC_REQ{}
+			if reqmsg.ParseWDCReq(wdcReq) == nil && filter.accept(reqmsg.DSTADDR) && filter.confirms(reqmsg) {
+				status := byte(worker.MAC_NO_ACK)
+				if !reqmsg.ACKREQ {
+					status = worker.MAC_TRANSACTION_EXPIRED
+				}
+				wdc.Write(worker.MakeDataCon(reqmsg.HANDLE, status))
+			}
+		}
+	}
+}
+
+// run a node until nodeWdcCh is closed, restarting it with backoff whenever
+// one of its goroutines fails; the other nodes and the wdc link keep running
+func superviseNode(name string, start nodeStarter, filter nodeFilter,
+	nodeWdcCh chan []byte, done chan bool, wdc io.Writer) {
+	defer close(done)
+	backoff := RESTART_MIN
+
+	for {
+		dlCh, ulCh, errCh := make(chan []byte), make(chan []byte), make(chan error)
+		started := clock.Now()
+		stopped, err := runNode(filter.accept, nodeWdcCh, dlCh, ulCh, errCh, start(dlCh, ulCh, errCh), wdc)
+		if stopped {
+			fmt.Println(name, "stopped")
+			return
+		}
+		if err == nil {
+			err = fmt.Errorf("stopped unexpectedly")
+		}
+
+		if clock.Since(started) > RESTART_MAX {
+			backoff = RESTART_MIN
+		}
+		fmt.Println(name, "failed:", err.Error()+", restarting in", backoff)
+		if !idle(filter, nodeWdcCh, backoff, wdc) {
+			fmt.Println(name, "stopped")
+			return
+		}
+		backoff *= 2
+		if backoff > RESTART_MAX {
+			backoff = RESTART_MAX
+		}
+	}
+}
 
 func main() {
-	nodeSerial := flag.String("nodeSerial", "", "serial device to connect to node")
-	wdcSerial := flag.String("wdcSerial", "", "serial device to connect to wdc")
-	fwdSerial := flag.String("fwdSerial", "", "serial device to read and forward data from a real node") // TODO: enable list of serial interfaces
+	nodeSerial := flag.String("nodeSerial", "", "link to a real node, passed through next to the emulated nodes: serial device (device[?baud=N&parity=N&stop=1&timeout=D]) or any -wdc link, e.g. pty://")
+	nodeSerialAddr := flag.Int("nodeSerialAddr", -1, "short address of the real node, -1 passes through all data requests not sent to an emulated node")
+	wdcLink := flag.String("wdc", "", "link to the wdc: serial device (serial://device[?baud=N&...] or device[?baud=N&...]), tcp://host:port, tcp-listen://[host]:port, udp://host:port, unix:///path, unix-listen:///path or pty://[/file] to create a pseudo-terminal and write its device to file")
+	wdcSerial := flag.String("wdcSerial", "", "serial device (device[?baud=N&parity=N&stop=1&timeout=D]) to connect to wdc, same as -wdc with a device")
+	fwdSerial := flag.String("fwdSerial", "", "comma separated serial devices (device[?baud=N&...]) to read and forward data from real nodes, one emulated node each")
 	nJamming := flag.Int("nJamming", 0, "number of sensors sending jamming data")
 	nSensors := flag.Int("nSensors", 0, "number of sensors sending arbitrary data")
 	secure := flag.Bool("sec", true, "apply security processing")
+	ouiHex := flag.String("oui", "020000", "OUI (hex) of the generated node EUI-64 addresses")
+	configFile := flag.String("config", "", "scenario file describing the coordinator and nodes, replaces the node flags")
+	virtualTime := flag.Bool("virtualTime", false, "run in virtual time, as fast as possible, e.g. for automated tests; the wdc and real nodes lose their timing")
+	seed := flag.Int64("seed", 0, "seed of the emulator randomness, runs with the same seed and scenario draw the same numbers; 0 for a random seed")
+	captureFile := flag.String("capture", "", "pcapng file to write the wdc messages and the MPDUs they carry to, for Wireshark")
+	insecureDRBG := flag.Bool("insecureDRBG", false, "INSECURE, for reproducible traces only: draw the ECDH private keys and IVs from a generator seeded with -seed")
 	flag.Parse()
 
-	// check serial devices
-	if *wdcSerial == "" {
-		fmt.Println("serial connection to wdc is not provided")
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	rng.Seed(*seed)
+	fmt.Println("random seed:", *seed)
+	if *insecureDRBG {
+		fmt.Println("WARNING: keys and IVs drawn from an insecure generator, do not use with real devices")
+	}
+
+	if *virtualTime {
+		clock.Set(clock.NewVirtual(time.Now()))
+		fmt.Println("running in virtual time")
+	}
+
+	oui, err := hex.DecodeString(*ouiHex)
+	if err != nil || len(oui) != 3 {
+		fmt.Println("invalid OUI:", *ouiHex)
 		os.Exit(1)
 	}
 
-	// register interrupt signal
-	intrCh := make(chan os.Signal)
-	signal.Notify(intrCh, os.Interrupt)
+	// check wdc link and serial devices
+	if *wdcLink == "" {
+		*wdcLink = *wdcSerial
+	}
+	var wdcEndpoint transport.Endpoint
+	if *wdcLink != "" {
+		if wdcEndpoint, err = transport.Parse(*wdcLink, config.WDCPort); err != nil {
+			fmt.Println("invalid wdc link:", err.Error())
+			os.Exit(1)
+		}
+	}
+	passthrough := passthroughNode{addr: *nodeSerialAddr}
+	if *nodeSerial != "" {
+		if passthrough.link, err = transport.Parse(*nodeSerial, config.NodePort); err != nil {
+			fmt.Println("invalid node serial link:", err.Error())
+			os.Exit(1)
+		}
+	}
 
 	// register total nodes and corresponding handler goroutines
-	mapNodes := make(map[int]node)
-	for i := 0; i < *nJamming; i++ {
-		mapNodes[i] = node{app.DoSendJamming, ""}
+	var mapNodes map[int]node
+	if *configFile != "" {
+		cfg, err := config.Load(*configFile)
+		if err != nil {
+			fmt.Println("error loading scenario:", err.Error())
+			os.Exit(1)
+		}
+		if mapNodes, err = nodesFromConfig(cfg, oui); err != nil {
+			fmt.Println("error loading scenario:", err.Error())
+			os.Exit(1)
+		}
+
+		if *wdcLink == "" && cfg.Coordinator.Serial.Device != "" {
+			wdcPort, _ := cfg.Coordinator.Serial.Port(config.WDCPort)
+			wdcEndpoint = transport.Serial(wdcPort)
+		}
+		if cfg.Coordinator.LongAddr != nil {
+			worker.CoordLongAddr = cfg.Coordinator.LongAddr
+		}
+		if cfg.Passthrough != nil && *nodeSerial == "" {
+			nodePort, _ := cfg.Passthrough.Port(config.NodePort)
+			passthrough.link = transport.Serial(nodePort)
+			passthrough.addr = -1
+			if cfg.Passthrough.Address != nil {
+				passthrough.addr = *cfg.Passthrough.Address
+			}
+		}
+	} else {
+		fwdDevices, err := serialport.ParseList(*fwdSerial, config.ForwardPort)
+		if err != nil {
+			fmt.Println("invalid forward serial device:", err.Error())
+			os.Exit(1)
+		}
+		mapNodes = nodesFromFlags(*nJamming, *nSensors, fwdDevices, *secure, oui)
 	}
-	for i := *nJamming; i < *nJamming+*nSensors; i++ {
-		mapNodes[i] = node{app.DoSendData, ""}
+
+	// nodes in the order of their addresses, so that runs seeded alike derive
+	// the same streams and start the nodes alike
+	addrs := make([]int, 0, len(mapNodes))
+	for addr := range mapNodes {
+		addrs = append(addrs, addr)
 	}
-	if *fwdSerial != "" {
-		mapNodes[*nJamming+*nSensors] = node{app.DoForwardData, *fwdSerial}
+	sort.Ints(addrs)
+	if *insecureDRBG {
+		for _, addr := range addrs {
+			n := mapNodes[addr]
+			n.config.KeyRand = rng.New()
+			mapNodes[addr] = n
+		}
+	}
+
+	if wdcEndpoint.Scheme == "" {
+		fmt.Println("connection to wdc is not provided")
+		os.Exit(1)
 	}
 
-	// configure serial device connecting to wdc
-	siface := &serial.Config{Name: *wdcSerial, Baud: 57600}
-	serReader, err := serial.OpenPort(siface)
+	// register interrupt signal
+	intrCh := make(chan os.Signal, 1)
+	signal.Notify(intrCh, os.Interrupt)
+
+	// configure link to the wdc
+	serReader, err := wdcEndpoint.Open()
 	if err != nil {
-		fmt.Println("error opening serial interface:", err.Error())
+		fmt.Println("error opening wdc link", wdcEndpoint.String()+":", err.Error())
 		os.Exit(1)
 	}
 	defer serReader.Close()
-	ser := SerialReader{serReader}
-	wdcCh := devreader.MakeChannel(ser)
-
-	for addr, curnode := range mapNodes {
-		// if nodeSerial is used, we just need one passthrough goroutine
-		if *nodeSerial != "" {
-			dlCh := make(chan []byte)
-			ulCh := make(chan []byte)
-			go worker.DoSerialDataRequest(dlCh, ulCh, *nodeSerial)
-			break
-		}
-
-		// otherwise, start one goroutine per node
-		go func(addr int, curnode node) {
-			nodeAddr := make([]byte, 2)
-			binary.LittleEndian.PutUint16(nodeAddr, uint16(addr))
-
-			// channel for receiving wdc message
-			nodeWdcCh := make(chan []byte)
-			nodeWdcChannels = append(nodeWdcChannels, nodeWdcCh)
-
-			// channels for node's processing goroutine
-			dlCh := make(chan []byte)
-			ulCh := make(chan []byte)
-			chPool = append(chPool, ulCh)
-
-			// channels for node's application goroutine
-			appDlCh := make(chan []byte)
-			appUlCh := make(chan []byte)
-
-			// channel for sharing data between worker and app
-			crossCh := make(chan []byte)
-
-			go curnode.appFunction(appDlCh, appUlCh, crossCh, curnode.device)
-			go worker.DoDataRequest(nodeAddr, dlCh, ulCh, appDlCh, appUlCh, crossCh, *secure)
-
-		LOOP:
-			for {
-				select {
-				case wdcReq, more := <-nodeWdcCh:
-					if !more {
-						close(dlCh)
-						break LOOP
-					}
+	wdcReader := worker.NewWDCReader(serReader)
 
-					reqmsg := worker.WDC_REQ{}
-					reqmsg.ParseWDCReq([]byte(wdcReq))
-					if bytes.Equal(reqmsg.DSTADDR, nodeAddr) || bytes.Equal(reqmsg.DSTADDR, []byte{0xff, 0xff}) { // only process message that is sent to us or broadcast
-						dlCh <- []byte(wdcReq)
-					}
+	// what is written to the wdc, captured if asked to
+	var wdc io.Writer = serReader
+	var capture *worker.Capture
+	if *captureFile != "" {
+		f, err := os.Create(*captureFile)
+		if err != nil {
+			fmt.Println("error creating capture file:", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		if capture, err = worker.NewCapture(f); err != nil {
+			fmt.Println("error writing capture file:", err.Error())
+			os.Exit(1)
+		}
+		wdc = capture.Writer(serReader)
+		fmt.Println("capturing to", *captureFile)
+	}
+	wdcCh := devreader.MakeChannel(wdcReader)
+	framingStats := wdcReader.Stats()
 
-				case nodeInd := <-ulCh:
-					//mutex.Lock()
-					serReader.Write(nodeInd) // ignore error on wdc serial write
-					//mutex.Unlock()
-					fmt.Println("sent node uplink message")
-				}
+	for _, addr := range addrs {
+		curnode := mapNodes[addr]
+		// channel for receiving wdc message
+		nodeWdcCh := make(chan []byte)
+		nodeWdcChannels = append(nodeWdcChannels, nodeWdcCh)
+		done := make(chan bool)
+		chPool = append(chPool, done)
+
+		nodeAddr := curnode.config.Addr
+		nodeLongAddr := worker.FrameAddr(curnode.config.EUI)
+		fmt.Println("node", hex.EncodeToString(nodeAddr), "EUI-64:", hex.EncodeToString(curnode.config.EUI))
+
+		// start one supervised node; worker and app goroutines, on every restart
+		filter := nodeFilter{func(dstAddr []byte) bool {
+			return bytes.Equal(dstAddr, nodeAddr) || bytes.Equal(dstAddr, nodeLongAddr)
+		}, curnode.config.Sleep.Poll > 0}
+		nodeFilters = append(nodeFilters, filter)
+
+		go superviseNode("node "+hex.EncodeToString(nodeAddr), func(curnode node) nodeStarter {
+			return func(dlCh, ulCh chan []byte, errCh chan<- error) int {
+				// channels for node's application goroutine
+				appDlCh := make(chan []byte)
+				appUlCh := make(chan []byte)
+
+				// channel for sharing data between worker and app
+				crossCh := make(chan []byte)
+
+				// keys shared by worker and app, fresh on every restart
+				nodeConfig := curnode.config
+				nodeConfig.Session = worker.NewSession(nodeConfig.Keys)
+
+				runGuarded(errCh, func() error {
+					return worker.RunApp(curnode.app, nodeConfig, curnode.device, appDlCh, appUlCh, crossCh)
+				})
+				runGuarded(errCh, func() error {
+					return worker.DoDataRequest(nodeConfig, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+				})
+				return 2
 			}
-			fmt.Println("node stopped")
-		}(addr, curnode)
+		}(curnode), filter, nodeWdcCh, done, wdc)
+	}
+
+	// real node connected through nodeSerial, next to the emulated ones
+	if passthrough.link.Scheme != "" {
+		nodeWdcCh := make(chan []byte)
+		nodeWdcChannels = append(nodeWdcChannels, nodeWdcCh)
+		filter := nodeFilter{accept: passthrough.accepts(mapNodes)}
+		nodeFilters = append(nodeFilters, filter)
+		done := make(chan bool)
+		chPool = append(chPool, done)
+
+		go superviseNode("real node on "+passthrough.link.String(), func(dlCh, ulCh chan []byte, errCh chan<- error) int {
+			linkCh := make(chan bool)
+			runGuarded(errCh, func() error {
+				return worker.DoSerialDataRequest(dlCh, ulCh, passthrough.link, linkCh)
+			})
+			go func() {
+				for up := range linkCh {
+					if up {
+						fmt.Println("real node on", passthrough.link.String(), "connected")
+					} else {
+						fmt.Println("real node on", passthrough.link.String(), "disconnected, data requests are dropped")
+					}
+				}
+			}()
+			return 1
+		}, filter, nodeWdcCh, done, wdc)
 	}
 
 MAINLOOP:
 	for {
 		select {
 		case wdcReq := <-wdcCh:
+			if stats := wdcReader.Stats(); stats.Resyncs != framingStats.Resyncs {
+				fmt.Printf("wdc framing errors: %d resyncs, %d bytes discarded\n", stats.Resyncs, stats.Discarded)
+				framingStats = stats
+			}
+			if capture != nil {
+				capture.Inbound(wdcReq)
+			}
+
+			// data requests to sleeping nodes are confirmed once polled or expired
+			reqmsg := worker.WDC_REQ{}
+			isDataReq := len(wdcReq) > 1 && wdcReq[1] == 0x17 && reqmsg.ParseWDCReq(wdcReq) == nil
+			filter, known := handledBy(reqmsg.DSTADDR)
+
 			wdcRes := worker.ProcessMessage(wdcReq)
+			if isDataReq && known && filter.confirms(reqmsg) {
+				wdcRes = nil
+			}
 			if wdcRes != nil {
 				//mutex.Lock()
-				serReader.Write(wdcRes) // ignore error on wdc serial write
+				wdc.Write(wdcRes) // ignore error on wdc serial write
 				//mutex.Unlock()
 				fmt.Println("sent answer to WDC request")
 			}
 
 			// if MAC_DATA_REQUEST, pass it to node goroutines
-			if len(wdcReq) != 0 && wdcReq[1] == 0x17 {
+			if len(wdcReq) > 1 && wdcReq[1] == 0x17 {
 				for _, ch := range nodeWdcChannels {
 					ch <- wdcReq
 				}
+
+				// nobody acknowledges a request to an unknown node
+				if isDataReq && reqmsg.ACKREQ && !known {
+					wdc.Write(worker.MakeDataCon(reqmsg.HANDLE, worker.MAC_NO_ACK))
+					fmt.Println("no node at", hex.EncodeToString(reqmsg.DSTADDR)+", data request not acknowledged")
+				}
 			}
 
 		case <-intrCh:
@@ -166,5 +458,8 @@ MAINLOOP:
 			break MAINLOOP
 		}
 	}
+	framingStats = wdcReader.Stats()
+	fmt.Printf("wdc framing: %d messages, %d resyncs, %d bytes discarded\n",
+		framingStats.Frames, framingStats.Resyncs, framingStats.Discarded)
 	fmt.Println("program stopped")
 }
@@ -9,6 +9,9 @@ import (
 	"io"
 )
 
+// source of the IVs, may be replaced for reproducible runs
+var Rand io.Reader = rand.Reader
+
 // encrypt AES-CBC
 // the composition of these functions doesn't feel right, to be refactored
 func aesEncryptCBC(key, plaintext, iv []byte) ([]byte, error) {
@@ -33,7 +36,7 @@ func aesEncryptCBC(key, plaintext, iv []byte) ([]byte, error) {
 
 func AESEncryptCBC(key, plaintext []byte) ([]byte, error) {
 	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	if _, err := io.ReadFull(Rand, iv); err != nil {
 		return nil, err
 	}
 
@@ -52,8 +55,16 @@ func aesEncryptCBCPKCS7(key, plaintext, iv []byte) ([]byte, error) {
 }
 
 func AESEncryptCBCPKCS7(key, plaintext []byte) ([]byte, error) {
+	return AESEncryptCBCPKCS7From(Rand, key, plaintext)
+}
+
+// same with the IV drawn from r, from Rand if r is nil
+func AESEncryptCBCPKCS7From(r io.Reader, key, plaintext []byte) ([]byte, error) {
+	if r == nil {
+		r = Rand
+	}
 	iv := make([]byte, aes.BlockSize)
-	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+	if _, err := io.ReadFull(r, iv); err != nil {
 		return nil, err
 	}
 
@@ -4,9 +4,13 @@ import (
 	ec "crypto/elliptic"
 	"crypto/rand"
 	"errors"
+	"io"
 	"math/big"
 )
 
+// source of the private keys, may be replaced for reproducible runs
+var Rand io.Reader = rand.Reader
+
 var (
 	// RFC 5114
 	P, _     = new(big.Int).SetString("FFFFFFFF00000001000000000000000000000000FFFFFFFFFFFFFFFFFFFFFFFF", 16)
@@ -21,8 +25,19 @@ var (
 )
 
 func GeneratePrivate() ([]byte, error) {
-	pk, err := rand.Int(rand.Reader, curve.N)
-	return pk.Bytes(), err
+	return GeneratePrivateFrom(Rand)
+}
+
+// private key drawn from r, from Rand if r is nil
+func GeneratePrivateFrom(r io.Reader) ([]byte, error) {
+	if r == nil {
+		r = Rand
+	}
+	pk, err := rand.Int(r, curve.N)
+	if err != nil {
+		return nil, err
+	}
+	return pk.Bytes(), nil
 }
 
 func GeneratePublic(privkey []byte) []byte {
@@ -31,6 +46,9 @@ func GeneratePublic(privkey []byte) []byte {
 }
 
 func CheckPublic(pubkey []byte) bool {
+	if len(pubkey) != 2*ByteSize {
+		return false
+	}
 	px := new(big.Int).SetBytes(pubkey[:ByteSize])
 	py := new(big.Int).SetBytes(pubkey[ByteSize:])
 	// TODO check if infinity
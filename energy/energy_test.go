@@ -0,0 +1,51 @@
+package energy
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	now := time.Unix(0, 0)
+	// 1 mAh between 3V and 2V stores 9 J
+	m := &Meter{Battery: Battery{Capacity: 1, Full: 3000, Empty: 2000}, Costs: DefaultCosts, Sleepy: true,
+		now: func() time.Time { return now }, since: now}
+	if e := m.Battery.Energy(); e != 9e6 {
+		t.Errorf("wrong output: %v, expected: %v", e, 9e6)
+	}
+	if v := m.Voltage(); v != 3000 {
+		t.Errorf("wrong output: %v, expected: 3000", v)
+	}
+
+	// 100 ECDH take a third of it, the rest drains asleep at 3µW in 2e6 s
+	for i := 0; i < 100; i++ {
+		m.Charge(ECDH, 1)
+	}
+	if v := m.Voltage(); math.Abs(v-2000-1000*2/3.0) > 1e-6 {
+		t.Errorf("wrong output: %v, expected: %v", v, 2000+1000*2/3.0)
+	}
+	now = now.Add(1000 * time.Second)
+	if r := m.Remaining(); math.Abs(r-(6e6-3000)/9e6) > 1e-9 {
+		t.Errorf("wrong output: %v, expected: %v", r, (6e6-3000)/9e6)
+	}
+	if !m.Charge(TX, 10) || m.Depleted() {
+		t.Errorf("battery depleted too early")
+	}
+
+	now = now.Add(2e6 * time.Second)
+	if m.Charge(TX, 10) || !m.Depleted() || m.Voltage() != 2000 {
+		t.Errorf("battery not depleted: %v", m.Remaining())
+	}
+}
+
+func TestCharge(t *testing.T) {
+	m := NewMeter(Battery{Capacity: 1000, Full: 3000, Empty: 2000}, Costs{TX: 1, RX: 2, AES: 3, HMAC: 4}, true)
+	m.Charge(TX, 10)  // 16 bytes with the PHY header
+	m.Charge(RX, 4)   // 10
+	m.Charge(AES, 17) // 2 blocks
+	m.Charge(HMAC, 1) // 1 block and the key blocks
+	if used := m.used; used != 16+20+6+12 {
+		t.Errorf("wrong output: %v, expected: %v", used, 16+20+6+12)
+	}
+}
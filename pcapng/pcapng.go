@@ -0,0 +1,115 @@
+// Package pcapng writes captures in the pcapng format, cf.
+// draft-ietf-opsawg-pcapng, for Wireshark
+package pcapng
+
+import (
+	"encoding/binary"
+	"io"
+	"sync"
+	"time"
+)
+
+// link types of the interfaces
+const (
+	LINKTYPE_USER0            = 147 // private use, e.g. the wdc messages
+	LINKTYPE_IEEE802_15_4_TAP = 283 // MPDU after a TAP header of TLVs
+)
+
+// directions of a packet, as epb_flags
+const (
+	INBOUND  = 1
+	OUTBOUND = 2
+)
+
+const (
+	BLOCK_SHB = 0x0a0d0d0a
+	BLOCK_IDB = 0x00000001
+	BLOCK_EPB = 0x00000006
+
+	OPT_ENDOFOPT = 0
+	OPT_IF_NAME  = 2
+	OPT_EPB_FLAG = 2
+)
+
+// Writer writes a section of interfaces and their packets, in little endian,
+// timestamps in microseconds; safe for concurrent use
+type Writer struct {
+	w          io.Writer
+	mutex      sync.Mutex
+	interfaces int
+}
+
+// start a section, with its header
+func NewWriter(w io.Writer) (*Writer, error) {
+	body := make([]byte, 16)
+	binary.LittleEndian.PutUint32(body[0:], 0x1a2b3c4d) // byte order magic
+	binary.LittleEndian.PutUint16(body[4:], 1)          // version 1.0
+	binary.LittleEndian.PutUint16(body[6:], 0)
+	binary.LittleEndian.PutUint64(body[8:], 0xffffffffffffffff) // section length not given
+	pw := &Writer{w: w}
+	return pw, pw.block(BLOCK_SHB, body)
+}
+
+// add an interface, returns its index for WritePacket
+func (w *Writer) AddInterface(linktype uint16, name string) (int, error) {
+	body := make([]byte, 8)
+	binary.LittleEndian.PutUint16(body[0:], linktype)
+	binary.LittleEndian.PutUint32(body[4:], 0) // no snap length
+	body = append(body, option(OPT_IF_NAME, []byte(name))...)
+	body = append(body, option(OPT_ENDOFOPT, nil)...)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if err := w.writeBlock(BLOCK_IDB, body); err != nil {
+		return 0, err
+	}
+	w.interfaces++
+	return w.interfaces - 1, nil
+}
+
+// write a packet seen on an interface at a time, in a direction
+func (w *Writer) WritePacket(iface int, ts time.Time, data []byte, direction uint32) error {
+	us := uint64(ts.UnixNano() / 1000)
+	body := make([]byte, 20)
+	binary.LittleEndian.PutUint32(body[0:], uint32(iface))
+	binary.LittleEndian.PutUint32(body[4:], uint32(us>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(us))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(data)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(data)))
+	body = append(body, pad(data)...)
+	flags := make([]byte, 4)
+	binary.LittleEndian.PutUint32(flags, direction)
+	body = append(body, option(OPT_EPB_FLAG, flags)...)
+	body = append(body, option(OPT_ENDOFOPT, nil)...)
+	return w.block(BLOCK_EPB, body)
+}
+
+func (w *Writer) block(blockType uint32, body []byte) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writeBlock(blockType, body)
+}
+
+// call with the mutex held
+func (w *Writer) writeBlock(blockType uint32, body []byte) error {
+	length := uint32(12 + len(body))
+	buf := make([]byte, 8, length)
+	binary.LittleEndian.PutUint32(buf[0:], blockType)
+	binary.LittleEndian.PutUint32(buf[4:], length)
+	buf = append(buf, body...)
+	buf = append(buf, buf[4:8]...) // length again
+	_, err := w.w.Write(buf)
+	return err
+}
+
+// option, or TLV, padded to 32 bits
+func option(code uint16, value []byte) []byte {
+	buf := make([]byte, 4)
+	binary.LittleEndian.PutUint16(buf[0:], code)
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(value)))
+	return append(buf, pad(value)...)
+}
+
+func pad(data []byte) []byte {
+	return append(append([]byte{}, data...), make([]byte, (4-len(data)%4)%4)...)
+}
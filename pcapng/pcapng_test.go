@@ -0,0 +1,63 @@
+package pcapng
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+	"time"
+)
+
+// split a section into its blocks, checking the lengths around them
+func blocks(t *testing.T, buf []byte) [][]byte {
+	var split [][]byte
+	for len(buf) > 0 {
+		length := binary.LittleEndian.Uint32(buf[4:])
+		if length%4 != 0 || int(length) > len(buf) || binary.LittleEndian.Uint32(buf[length-4:]) != length {
+			t.Fatalf("invalid block: %x", buf)
+		}
+		split, buf = append(split, buf[:length]), buf[length:]
+	}
+	return split
+}
+
+func TestWriter(t *testing.T) {
+	out := &bytes.Buffer{}
+	w, _ := NewWriter(out)
+	if iface, err := w.AddInterface(LINKTYPE_USER0, "wdc"); iface != 0 || err != nil {
+		t.Errorf("wrong output: %v %v, expected: 0 <nil>", iface, err)
+	}
+	if iface, err := w.AddInterface(LINKTYPE_IEEE802_15_4_TAP, "air"); iface != 1 || err != nil {
+		t.Errorf("wrong output: %v %v, expected: 1 <nil>", iface, err)
+	}
+	w.WritePacket(1, time.Unix(1, 2000), []byte{0x03, 0x18, 0x2a}, OUTBOUND)
+
+	split := blocks(t, out.Bytes())
+	if len(split) != 4 {
+		t.Fatalf("wrong number of blocks: %v, expected: 4", len(split))
+	}
+	shb, _ := hex.DecodeString("0a0d0d0a1c0000004d3c2b1a01000000ffffffffffffffff1c000000")
+	if !bytes.Equal(split[0], shb) {
+		t.Errorf("wrong output: %x, expected: %x", split[0], shb)
+	}
+	idb, _ := hex.DecodeString("01000000200000001b01000000000000" + "02000300616972000000000020000000")
+	if !bytes.Equal(split[2], idb) {
+		t.Errorf("wrong output: %x, expected: %x", split[2], idb)
+	}
+	// interface 1, 1000002us, 3 bytes, outbound
+	epb, _ := hex.DecodeString("0600000030000000010000000000000042420f00030000000300000003182a00" + "02000400020000000000000030000000")
+	if !bytes.Equal(split[3], epb) {
+		t.Errorf("wrong output: %x, expected: %x", split[3], epb)
+	}
+}
+
+func TestTAP(t *testing.T) {
+	frame := TAP([]byte{0x01, 0x98}, FCSType(0), LQI(180))
+	expected, _ := hex.DecodeString("0000140000000100000000000a000100b40000000198")
+	if !bytes.Equal(frame, expected) {
+		t.Errorf("wrong output: %x, expected: %x", frame, expected)
+	}
+	if rss := RSS(-50).Value; !bytes.Equal(rss, []byte{0x00, 0x00, 0x48, 0xc2}) {
+		t.Errorf("wrong output: %x, expected: 000048c2", rss)
+	}
+}
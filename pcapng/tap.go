@@ -0,0 +1,42 @@
+package pcapng
+
+import (
+	"encoding/binary"
+	"math"
+)
+
+// TLVs of the IEEE 802.15.4 TAP header
+const (
+	TAP_FCS_TYPE = 0  // 1 byte: 0 no FCS, 1 16-bit CRC, 2 32-bit CRC
+	TAP_RSS      = 1  // float32, dBm
+	TAP_LQI      = 10 // 1 byte
+)
+
+type TLV struct {
+	Type  uint16
+	Value []byte
+}
+
+func FCSType(fcs byte) TLV {
+	return TLV{TAP_FCS_TYPE, []byte{fcs}}
+}
+
+func RSS(dBm float64) TLV {
+	v := make([]byte, 4)
+	binary.LittleEndian.PutUint32(v, math.Float32bits(float32(dBm)))
+	return TLV{TAP_RSS, v}
+}
+
+func LQI(lqi byte) TLV {
+	return TLV{TAP_LQI, []byte{lqi}}
+}
+
+// MPDU with its TAP header, for LINKTYPE_IEEE802_15_4_TAP
+func TAP(mpdu []byte, tlvs ...TLV) []byte {
+	buf := make([]byte, 4) // version 0, reserved, length
+	for _, tlv := range tlvs {
+		buf = append(buf, option(tlv.Type, tlv.Value)...)
+	}
+	binary.LittleEndian.PutUint16(buf[2:], uint16(len(buf)))
+	return append(buf, mpdu...)
+}
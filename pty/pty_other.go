@@ -0,0 +1,22 @@
+//go:build !linux
+// +build !linux
+
+package pty
+
+import (
+	"fmt"
+	"os"
+)
+
+type Pair struct {
+	Master *os.File
+	Peer   string
+}
+
+func Open() (*Pair, error) {
+	return nil, fmt.Errorf("pseudo-terminal pairs are only supported on linux")
+}
+
+func (p *Pair) Close() error {
+	return p.Master.Close()
+}
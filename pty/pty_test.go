@@ -0,0 +1,41 @@
+//go:build linux
+// +build linux
+
+package pty
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestPair(t *testing.T) {
+	p, err := Open()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err.Error())
+	}
+	defer p.Close()
+
+	peer, err := os.OpenFile(p.Peer, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("error opening peer: %v", err.Error())
+	}
+	defer peer.Close()
+
+	// bytes a terminal would translate or swallow
+	msg := []byte{0x0d, 0x0a, 0x03, 0x11, 0x13, 0x7f, 0x04, 0xff}
+	if _, err := p.Master.Write(msg); err != nil {
+		t.Fatalf("error writing: %v", err.Error())
+	}
+	buf := make([]byte, len(msg))
+	for n := 0; n < len(msg); {
+		m, err := peer.Read(buf[n:])
+		if err != nil {
+			t.Fatalf("error reading: %v", err.Error())
+		}
+		n += m
+	}
+	if !bytes.Equal(buf, msg) {
+		t.Errorf("wrong output: %v, expected: %v", buf, msg)
+	}
+}
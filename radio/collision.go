@@ -0,0 +1,95 @@
+package radio
+
+import (
+	"github.com/herrfz/coordnode/clock"
+	"sync"
+	"time"
+)
+
+// O-QPSK at 2.45 GHz, 250 kbit/s
+const (
+	BYTE_TIME  = 32 * time.Microsecond
+	PHY_HEADER = 6 // preamble, SFD and PHR
+)
+
+// time on the air of a PSDU of n bytes
+func Airtime(n int) time.Duration {
+	return time.Duration(PHY_HEADER+n) * BYTE_TIME
+}
+
+// Channel is the air shared by the uplinks of the nodes: frames overlapping in
+// time collide, and the strongest of them may still be received (capture
+// effect); with TDMA the uplinks wait for the slot of their node
+type Channel struct {
+	SlotLength time.Duration // no slots if 0
+	Slots      int           // per cycle
+	mutex      sync.Mutex
+	frames     []*frame // on the air or about to be
+	start      time.Time
+}
+
+type frame struct {
+	start, end   time.Time
+	power        float64 // dBm
+	others       int     // overlapping frames
+	interference float64 // mW, their sum
+}
+
+// the TDMA cycles start with the channel
+func NewChannel(slotLength time.Duration, slots int) *Channel {
+	return &Channel{SlotLength: slotLength, Slots: slots, start: clock.Now()}
+}
+
+// next start of a slot after now
+func (c *Channel) slotStart(now time.Time, slot int) time.Time {
+	cycle := c.SlotLength * time.Duration(c.Slots)
+	elapsed := now.Sub(c.start)
+	start := elapsed - elapsed%cycle + time.Duration(slot%c.Slots)*c.SlotLength
+	if start < elapsed {
+		start += cycle
+	}
+	return c.start.Add(start)
+}
+
+// Transmit puts an uplink of n bytes on the air, in its slot if tdma is set,
+// received at the coordinator with a power in dBm. It returns once the frame
+// has been sent, with the number of frames it overlapped and the probability
+// that it was received nevertheless
+func (c *Channel) Transmit(n int, power float64, slot int, tdma bool) (others int, survive float64) {
+	now := clock.Now()
+	start := now
+	if tdma && c.SlotLength > 0 && c.Slots > 0 {
+		start = c.slotStart(now, slot)
+	}
+	f := &frame{start: start, end: start.Add(Airtime(n)), power: power}
+
+	// frames that ended cannot overlap the ones to come
+	c.mutex.Lock()
+	frames := c.frames[:0]
+	for _, o := range c.frames {
+		if o.end.Before(now) {
+			continue
+		}
+		frames = append(frames, o)
+		if o.start.Before(f.end) && f.start.Before(o.end) {
+			o.others, o.interference = o.others+1, o.interference+toMilliwatt(f.power)
+			f.others, f.interference = f.others+1, f.interference+toMilliwatt(o.power)
+		}
+	}
+	c.frames = append(frames, f)
+	c.mutex.Unlock()
+
+	clock.Sleep(f.end.Sub(now))
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if f.others == 0 {
+		return 0, 1
+	}
+	return f.others, 1 - FrameErrorRate(f.power-toDBm(f.interference))
+}
+
+// received power of a frame with a given LQI
+func PowerFromLQI(lqi byte) float64 {
+	return NOISE_FLOOR + SINRFromLQI(lqi)
+}
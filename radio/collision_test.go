@@ -0,0 +1,56 @@
+package radio
+
+import (
+	"testing"
+	"time"
+)
+
+type transmission struct {
+	others  int
+	survive float64
+}
+
+// two uplinks sent at once
+func transmitTogether(c *Channel, powers [2]float64, slots [2]int, tdma bool) [2]transmission {
+	results := [2]chan transmission{make(chan transmission), make(chan transmission)}
+	for i := range results {
+		go func(i int) {
+			others, survive := c.Transmit(50, powers[i], slots[i], tdma)
+			results[i] <- transmission{others, survive}
+		}(i)
+	}
+	return [2]transmission{<-results[0], <-results[1]}
+}
+
+func TestChannel(t *testing.T) {
+	if d := Airtime(50); d != 1792*time.Microsecond {
+		t.Errorf("wrong output: %v, expected: 1.792ms", d)
+	}
+
+	// contention: both collide, the stronger is captured
+	c := NewChannel(0, 0)
+	tx := transmitTogether(c, [2]float64{-60, -60}, [2]int{0, 0}, false)
+	if tx[0].others != 1 || tx[1].others != 1 || tx[0].survive > 0.01 {
+		t.Errorf("wrong output: %+v, expected a collision", tx)
+	}
+	tx = transmitTogether(c, [2]float64{-50, -70}, [2]int{0, 0}, false)
+	if tx[0].survive < 0.99 || tx[1].survive > 0.01 {
+		t.Errorf("wrong output: %+v, expected the first captured", tx)
+	}
+
+	// one after the other
+	for i := 0; i < 2; i++ {
+		if others, survive := c.Transmit(50, -60, 0, false); others != 0 || survive != 1 {
+			t.Errorf("wrong output: %v %v, expected: 0 1", others, survive)
+		}
+	}
+
+	// TDMA: only the nodes sharing a slot collide
+	c = NewChannel(5*time.Millisecond, 2)
+	if tx = transmitTogether(c, [2]float64{-60, -60}, [2]int{0, 1}, true); tx[0].others != 0 || tx[1].others != 0 {
+		t.Errorf("wrong output: %+v, expected no collision", tx)
+	}
+	if tx = transmitTogether(c, [2]float64{-60, -60}, [2]int{1, 1}, true); tx[0].others != 1 || tx[1].others != 1 {
+		t.Errorf("wrong output: %+v, expected a collision", tx)
+	}
+}
@@ -0,0 +1,150 @@
+package radio
+
+import (
+	"github.com/herrfz/coordnode/clock"
+	"math"
+	"time"
+)
+
+// Jammer is a transmitter interfering with the nodes, either on the whole
+// channel or only in the time slots of some nodes
+type Jammer struct {
+	Position    Point
+	Power       float64       // dBm
+	Start, Stop time.Duration // after the medium is created, Stop 0 for never
+	Slots       []int         // targeted slots, all if empty
+	Corrupt     float64       // share of the jammed frames received with bit errors instead of lost
+}
+
+func (j Jammer) Active(elapsed time.Duration) bool {
+	return elapsed >= j.Start && (j.Stop == 0 || elapsed < j.Stop)
+}
+
+func (j Jammer) Targets(slot int) bool {
+	if len(j.Slots) == 0 {
+		return true
+	}
+	for _, s := range j.Slots {
+		if s == slot {
+			return true
+		}
+	}
+	return false
+}
+
+// Medium is the channel shared by all nodes of a scenario
+type Medium struct {
+	Jammers     []Jammer
+	Propagation Propagation // free space if not set
+	Coordinator Point
+	start       time.Time
+}
+
+// the jammer schedules and mobility traces start with the medium
+func NewMedium(jammers []Jammer) *Medium {
+	return &Medium{Jammers: jammers, start: clock.Now()}
+}
+
+func (m *Medium) loss(a, b Point) float64 {
+	if m.Propagation.Exponent == 0 {
+		return FreeSpace.Loss(a, b)
+	}
+	return m.Propagation.Loss(a, b)
+}
+
+// current position of a transmitter
+func (m *Medium) Position(t Transmitter) Point {
+	if t.Mobility != nil {
+		return t.Mobility.Position(clock.Since(m.start))
+	}
+	return t.Position
+}
+
+// interference power in dBm at a position in a slot, -Inf if there is none;
+// slot -1 sums up all active jammers, as seen by energy detection over all
+// slots
+func (m *Medium) Interference(pos Point, slot int) float64 {
+	elapsed := clock.Since(m.start)
+	mW := 0.0
+	for _, j := range m.Jammers {
+		if j.Active(elapsed) && (slot < 0 || j.Targets(slot)) {
+			mW += toMilliwatt(j.Power - m.loss(pos, j.Position))
+		}
+	}
+	return toDBm(mW)
+}
+
+// corrupted share of the frames lost to interference at a position in a slot,
+// from the strongest jammer
+func (m *Medium) corruptShare(pos Point, slot int) float64 {
+	elapsed := clock.Since(m.start)
+	strongest, share := math.Inf(-1), 0.0
+	for _, j := range m.Jammers {
+		if j.Active(elapsed) && j.Targets(slot) {
+			if p := j.Power - m.loss(pos, j.Position); p > strongest {
+				strongest, share = p, j.Corrupt
+			}
+		}
+	}
+	return share
+}
+
+// Quality is the state of the uplink of a node, as received by the coordinator
+type Quality struct {
+	LQI, ED byte
+	Lost    float64 // probability of losing a frame
+	Corrupt float64 // probability of receiving a frame with bit errors
+}
+
+// quality of a link with the given LQI, ED and loss probability without
+// interference, for a node at a position sending in a slot; the node sees the
+// interference at its own position
+func (m *Medium) Quality(lqi, ed byte, loss float64, pos Point, slot int) Quality {
+	q := Quality{LQI: lqi, ED: ed, Lost: loss}
+	interference := m.Interference(pos, slot)
+	if math.IsInf(interference, -1) {
+		return q
+	}
+
+	noise := toDBm(toMilliwatt(NOISE_FLOOR) + toMilliwatt(interference))
+	if e := EDFromPower(noise); e > q.ED {
+		q.ED = e
+	}
+	sinr := NOISE_FLOOR + SINRFromLQI(lqi) - noise
+	q.LQI = LQIFromSINR(sinr)
+
+	jammed := FrameErrorRate(sinr) - FrameErrorRate(SINRFromLQI(lqi))
+	if jammed > 0 {
+		share := m.corruptShare(pos, slot)
+		q.Corrupt = (1 - loss) * jammed * share
+		q.Lost = loss + (1-loss)*jammed*(1-share)
+	}
+	return q
+}
+
+// quality of the uplink of a transmitter to the coordinator, with an additional
+// loss probability: the signal comes from the path loss, the interference of
+// the jammers is the one at the transmitter, as in Quality
+func (m *Medium) Uplink(t Transmitter, loss float64) Quality {
+	pos := m.Position(t)
+	rssi := m.Received(t)
+	noise := toDBm(toMilliwatt(NOISE_FLOOR) + toMilliwatt(m.Interference(pos, t.Slot)))
+	sinr := rssi - noise
+
+	q := Quality{LQI: LQIFromSINR(sinr), ED: EDFromPower(toDBm(toMilliwatt(rssi) + toMilliwatt(noise)))}
+	per := FrameErrorRate(sinr)
+	share := m.corruptShare(pos, t.Slot)
+	q.Corrupt = (1 - loss) * per * share
+	q.Lost = loss + (1-loss)*per*(1-share)
+	return q
+}
+
+// power in dBm of the uplinks of a transmitter at the coordinator
+func (m *Medium) Received(t Transmitter) float64 {
+	return t.Power - m.loss(m.Position(t), m.Coordinator) - t.Shadow
+}
+
+// energy detected by a node at a position, over all slots
+func (m *Medium) EnergyDetect(pos Point) byte {
+	return EDFromPower(toDBm(toMilliwatt(NOISE_FLOOR) + toMilliwatt(m.Interference(pos, -1))))
+}
@@ -0,0 +1,57 @@
+package radio
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestQuality(t *testing.T) {
+	node := Point{X: 2}
+	clean := Quality{LQI: 180, ED: 20, Lost: 0.05}
+
+	// nothing active for the node: later schedule, other slot
+	m := NewMedium([]Jammer{
+		{Power: 0, Start: time.Hour},
+		{Power: 0, Slots: []int{3, 4}},
+	})
+	if q := m.Quality(180, 20, 0.05, node, 1); q != clean {
+		t.Errorf("wrong output: %+v, expected: %+v", q, clean)
+	}
+	if q := m.Quality(180, 20, 0.05, node, 3); q.LQI >= clean.LQI || q.ED <= clean.ED {
+		t.Errorf("wrong output: %+v, expected lower LQI and higher ED than %+v", q, clean)
+	}
+
+	// 0 dBm at 2m is -46 dBm, far above the signal
+	m = NewMedium([]Jammer{{Power: 0, Corrupt: 0.25}})
+	q := m.Quality(180, 20, 0.05, node, 1)
+	if q.LQI != 0 || q.ED != 229 {
+		t.Errorf("wrong output: %v %v, expected: 0 229", q.LQI, q.ED)
+	}
+	if q.Lost < 0.7 || math.Abs(q.Corrupt*3-(q.Lost-0.05)) > 1e-9 {
+		t.Errorf("wrong output: lost %v, corrupt %v", q.Lost, q.Corrupt)
+	}
+	if ed := m.EnergyDetect(node); ed != 229 {
+		t.Errorf("wrong output: %v, expected: 229", ed)
+	}
+
+	// farther away is weaker
+	if far := m.Quality(180, 20, 0.05, Point{X: 200}, 1); far.LQI <= q.LQI || far.Lost >= q.Lost {
+		t.Errorf("wrong output: %+v, expected better than %+v", far, q)
+	}
+}
+
+func TestConversions(t *testing.T) {
+	if ed := EDFromPower(NOISE_FLOOR + ED_RANGE + 10); ed != 255 {
+		t.Errorf("wrong output: %v, expected: 255", ed)
+	}
+	if ed := EDFromPower(PowerFromED(100)); ed != 100 {
+		t.Errorf("wrong output: %v, expected: 100", ed)
+	}
+	if lqi := LQIFromSINR(SINRFromLQI(180)); lqi != 180 {
+		t.Errorf("wrong output: %v, expected: 180", lqi)
+	}
+	if per := FrameErrorRate(3); per != 0.5 {
+		t.Errorf("wrong output: %v, expected: 0.5", per)
+	}
+}
@@ -0,0 +1,117 @@
+package radio
+
+import (
+	"encoding/csv"
+	"fmt"
+	"github.com/herrfz/coordnode/rng"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Wall attenuates the signals crossing it, it stands on the floor plan
+// between A and B over all heights
+type Wall struct {
+	A, B        Point
+	Attenuation float64 // dB
+}
+
+// Propagation is a log-distance path loss model with walls; shadowing is drawn
+// once per link
+type Propagation struct {
+	RefLoss     float64 // dB at RefDistance
+	RefDistance float64 // m, closer counts as RefDistance
+	Exponent    float64
+	Shadowing   float64 // standard deviation in dB
+	Walls       []Wall
+}
+
+// free space at 2.45 GHz, as PathLoss
+var FreeSpace = Propagation{RefLoss: 40.2, RefDistance: 1, Exponent: 2}
+
+// path loss in dB between two points, without shadowing
+func (p Propagation) Loss(a, b Point) float64 {
+	d := math.Max(a.Distance(b), p.RefDistance)
+	loss := p.RefLoss + 10*p.Exponent*math.Log10(d/p.RefDistance)
+	for _, w := range p.Walls {
+		if crosses(a, b, w.A, w.B) {
+			loss += w.Attenuation
+		}
+	}
+	return loss
+}
+
+// shadowing of a new link in dB
+func (p Propagation) Shadow() float64 {
+	return rng.NormFloat64() * p.Shadowing
+}
+
+// whether the segments ab and cd cross on the floor plan
+func crosses(a, b, c, d Point) bool {
+	side := func(p, q, r Point) float64 {
+		return (q.X-p.X)*(r.Y-p.Y) - (q.Y-p.Y)*(r.X-p.X)
+	}
+	return side(a, b, c)*side(a, b, d) < 0 && side(c, d, a)*side(c, d, b) < 0
+}
+
+// Trace moves a node through recorded positions, linearly in between; it
+// stays at the last one
+type Trace struct {
+	Times  []time.Duration // ascending, from zero
+	Points []Point
+}
+
+// parse a trace from CSV rows of seconds since the start, x, y and z in metres
+func ParseTrace(r io.Reader) (Trace, error) {
+	tr := Trace{}
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return tr, err
+	}
+	for i, row := range rows {
+		if len(row) != 4 {
+			return tr, fmt.Errorf("trace line %d: expected seconds, x, y and z", i+1)
+		}
+		var v [4]float64
+		for j := range v {
+			if v[j], err = strconv.ParseFloat(strings.TrimSpace(row[j]), 64); err != nil {
+				return tr, fmt.Errorf("trace line %d: invalid number %q", i+1, row[j])
+			}
+		}
+		t := time.Duration(v[0] * float64(time.Second))
+		if t < 0 || (len(tr.Times) > 0 && t <= tr.Times[len(tr.Times)-1]) {
+			return tr, fmt.Errorf("trace line %d: invalid time %q, must be ascending", i+1, row[0])
+		}
+		tr.Times = append(tr.Times, t)
+		tr.Points = append(tr.Points, Point{v[1], v[2], v[3]})
+	}
+	if len(tr.Points) == 0 {
+		return tr, fmt.Errorf("empty trace")
+	}
+	return tr, nil
+}
+
+func (tr Trace) Position(elapsed time.Duration) Point {
+	if elapsed <= tr.Times[0] {
+		return tr.Points[0]
+	}
+	for i := 1; i < len(tr.Times); i++ {
+		if elapsed < tr.Times[i] {
+			f := float64(elapsed-tr.Times[i-1]) / float64(tr.Times[i]-tr.Times[i-1])
+			a, b := tr.Points[i-1], tr.Points[i]
+			return Point{a.X + f*(b.X-a.X), a.Y + f*(b.Y-a.Y), a.Z + f*(b.Z-a.Z)}
+		}
+	}
+	return tr.Points[len(tr.Points)-1]
+}
+
+// Transmitter is the radio of a node sending to the coordinator
+type Transmitter struct {
+	Power    float64 // dBm
+	Position Point
+	Mobility *Trace // replaces Position if set
+	Slot     int
+	Shadow   float64 // dB, cf. Propagation.Shadow
+}
@@ -0,0 +1,76 @@
+package radio
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPropagation(t *testing.T) {
+	p := Propagation{RefLoss: 40, RefDistance: 1, Exponent: 3,
+		Walls: []Wall{{A: Point{X: 5, Y: -1}, B: Point{X: 5, Y: 1}, Attenuation: 6}}}
+
+	tests := []struct {
+		b    Point
+		loss float64
+	}{
+		{Point{X: 0.5}, 40}, // closer than the reference distance
+		{Point{Y: 10}, 70},  // along the wall
+		{Point{X: 10}, 76},  // through the wall
+	}
+	for _, test := range tests {
+		if loss := p.Loss(Point{}, test.b); loss != test.loss {
+			t.Errorf("wrong output: %v, expected: %v", loss, test.loss)
+		}
+	}
+
+	// walls stand over all heights
+	open := Propagation{RefLoss: 40, RefDistance: 1, Exponent: 3}
+	if loss := p.Loss(Point{}, Point{X: 10, Z: 3}) - open.Loss(Point{}, Point{X: 10, Z: 3}); loss != 6 {
+		t.Errorf("wrong output: %v, expected: 6", loss)
+	}
+
+	// the link through the wall, farther away or from a moving node is worse
+	m := NewMedium(nil)
+	m.Propagation = p
+	near := m.Uplink(Transmitter{Position: Point{X: 4}}, 0)
+	walled := m.Uplink(Transmitter{Position: Point{X: 6}}, 0)
+	if walled.LQI >= near.LQI || walled.ED >= near.ED {
+		t.Errorf("wrong output: %+v, expected worse than %+v", walled, near)
+	}
+	far := m.Uplink(Transmitter{Position: Point{X: 400}}, 0.1)
+	if far.Lost < 0.99 || far.Corrupt != 0 {
+		t.Errorf("wrong output: %+v, expected lost", far)
+	}
+	moving := Transmitter{Position: Point{X: 4}, Mobility: &Trace{Times: []time.Duration{0}, Points: []Point{{X: 400}}}}
+	if q := m.Uplink(moving, 0.1); q != far {
+		t.Errorf("wrong output: %+v, expected: %+v", q, far)
+	}
+}
+
+func TestTrace(t *testing.T) {
+	tr, err := ParseTrace(strings.NewReader("0, 0, 0, 1\n10, 10, 0, 1\n30, 10, 20, 1\n"))
+	if err != nil {
+		t.Fatalf("error parsing: %v", err.Error())
+	}
+	tests := []struct {
+		elapsed time.Duration
+		pos     Point
+	}{
+		{0, Point{0, 0, 1}},
+		{5 * time.Second, Point{5, 0, 1}},
+		{20 * time.Second, Point{10, 10, 1}},
+		{time.Hour, Point{10, 20, 1}},
+	}
+	for _, test := range tests {
+		if pos := tr.Position(test.elapsed); pos != test.pos {
+			t.Errorf("wrong output: %+v, expected: %+v", pos, test.pos)
+		}
+	}
+
+	for _, trace := range []string{"", "0, 1, 2\n", "0, 0, 0, 0\n0, 1, 1, 1\n", "0, x, 0, 0\n"} {
+		if _, err := ParseTrace(strings.NewReader(trace)); err == nil {
+			t.Errorf("no error parsing %q", trace)
+		}
+	}
+}
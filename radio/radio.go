@@ -0,0 +1,65 @@
+// This package models the radio channel shared by the emulated nodes, i.e.
+// the interference of jammers on the links to the coordinator
+package radio
+
+import "math"
+
+// position in metres
+type Point struct {
+	X, Y, Z float64
+}
+
+func (p Point) Distance(q Point) float64 {
+	return math.Sqrt((p.X-q.X)*(p.X-q.X) + (p.Y-q.Y)*(p.Y-q.Y) + (p.Z-q.Z)*(p.Z-q.Z))
+}
+
+// energy detection covers NOISE_FLOOR to NOISE_FLOOR+ED_RANGE dBm linearly, as
+// required by IEEE 802.15.4; LQI uses the same scale for the signal above the
+// noise and interference
+const (
+	NOISE_FLOOR = -100.0 // dBm
+	ED_RANGE    = 60.0   // dB
+)
+
+// free space loss at 2.45 GHz in dB, distances below 1m count as 1m
+func PathLoss(d float64) float64 {
+	return 40.2 + 20*math.Log10(math.Max(d, 1))
+}
+
+// ED value of a received power
+func EDFromPower(dBm float64) byte {
+	return scale(dBm - NOISE_FLOOR)
+}
+
+// received power of an ED value
+func PowerFromED(ed byte) float64 {
+	return NOISE_FLOOR + float64(ed)*ED_RANGE/255
+}
+
+// LQI value of a signal to noise and interference ratio
+func LQIFromSINR(sinr float64) byte {
+	return scale(sinr)
+}
+
+// signal to noise ratio of an LQI value
+func SINRFromLQI(lqi byte) float64 {
+	return float64(lqi) * ED_RANGE / 255
+}
+
+// probability of a frame error at a signal to noise and interference ratio,
+// 50% at 3 dB and falling off steeply above
+func FrameErrorRate(sinr float64) float64 {
+	return 1 / (1 + math.Exp(2*(sinr-3)))
+}
+
+func scale(dB float64) byte {
+	return byte(math.Round(math.Max(0, math.Min(255, dB*255/ED_RANGE))))
+}
+
+func toMilliwatt(dBm float64) float64 {
+	return math.Pow(10, dBm/10)
+}
+
+func toDBm(mW float64) float64 {
+	return 10 * math.Log10(mW)
+}
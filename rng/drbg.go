@@ -0,0 +1,35 @@
+package rng
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/binary"
+	"sync"
+)
+
+// InsecureDRBG is an AES-CTR key stream keyed by a hash of the seed. It is
+// NOT SECURE: anyone knowing the seed knows every key and IV drawn from it; it
+// only makes the traces of the emulator reproducible
+type InsecureDRBG struct {
+	mutex  sync.Mutex
+	stream cipher.Stream
+}
+
+func NewInsecureDRBG(seed int64) *InsecureDRBG {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, uint64(seed))
+	key := sha256.Sum256(append([]byte("coordnode insecure drbg"), buf...))
+	c, _ := aes.NewCipher(key[:]) // a valid key size
+	return &InsecureDRBG{stream: cipher.NewCTR(c, make([]byte, aes.BlockSize))}
+}
+
+func (d *InsecureDRBG) Read(p []byte) (int, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	for i := range p {
+		p[i] = 0
+	}
+	d.stream.XORKeyStream(p, p)
+	return len(p), nil
+}
@@ -0,0 +1,87 @@
+// Package rng is the randomness of the emulator: runs seeded alike draw the
+// same numbers
+package rng
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// Rand is a source safe for concurrent use; a nil *Rand draws from the
+// global source
+type Rand struct {
+	mutex sync.Mutex
+	r     *rand.Rand
+}
+
+func NewRand(seed int64) *Rand {
+	return &Rand{r: rand.New(rand.NewSource(seed))}
+}
+
+var global = NewRand(time.Now().UnixNano())
+
+// seed the global source, before the sources of the nodes are derived
+func Seed(seed int64) {
+	global.mutex.Lock()
+	defer global.mutex.Unlock()
+	global.r = rand.New(rand.NewSource(seed))
+}
+
+// new source derived from the global one: the sources created in the same
+// order get the same numbers, however their users are scheduled
+func New() *Rand {
+	return global.New()
+}
+
+// new source derived from this one, for a user of its own
+func (r *Rand) New() *Rand {
+	return NewRand(r.Int63())
+}
+
+func (r *Rand) lock() *rand.Rand {
+	if r == nil {
+		r = global
+	}
+	r.mutex.Lock()
+	return r.r
+}
+
+func (r *Rand) unlock() {
+	if r == nil {
+		r = global
+	}
+	r.mutex.Unlock()
+}
+
+func (r *Rand) Int63() int64 {
+	defer r.unlock()
+	return r.lock().Int63()
+}
+
+func (r *Rand) Int63n(n int64) int64 {
+	defer r.unlock()
+	return r.lock().Int63n(n)
+}
+
+func (r *Rand) Intn(n int) int {
+	defer r.unlock()
+	return r.lock().Intn(n)
+}
+
+func (r *Rand) Float64() float64 {
+	defer r.unlock()
+	return r.lock().Float64()
+}
+
+func (r *Rand) NormFloat64() float64 {
+	defer r.unlock()
+	return r.lock().NormFloat64()
+}
+
+// the global source
+
+func Int63n(n int64) int64 { return global.Int63n(n) }
+func Intn(n int) int       { return global.Intn(n) }
+func Float64() float64     { return global.Float64() }
+func NormFloat64() float64 { return global.NormFloat64() }
@@ -0,0 +1,47 @@
+package rng
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSeed(t *testing.T) {
+	draw := func() []float64 {
+		Seed(42)
+		a, b := New(), New()
+		return []float64{b.Float64(), a.Float64(), Float64()}
+	}
+	first, second := draw(), draw()
+	for i := range first {
+		if first[i] != second[i] {
+			t.Errorf("wrong output: %v, expected: %v", second, first)
+		}
+	}
+	if first[0] == first[1] {
+		t.Errorf("derived sources draw alike: %v", first)
+	}
+
+	// a nil source is the global one
+	var r *Rand
+	Seed(42)
+	New()
+	New()
+	if f := r.Float64(); f != first[2] {
+		t.Errorf("wrong output: %v, expected: %v", f, first[2])
+	}
+}
+
+func TestInsecureDRBG(t *testing.T) {
+	a, b, c := make([]byte, 40), make([]byte, 40), make([]byte, 40)
+	NewInsecureDRBG(1).Read(a)
+	d := NewInsecureDRBG(1)
+	d.Read(b[:16])
+	d.Read(b[16:])
+	NewInsecureDRBG(2).Read(c)
+	if !bytes.Equal(a, b) {
+		t.Errorf("wrong output: %x, expected: %x", b, a)
+	}
+	if bytes.Equal(a, c) {
+		t.Errorf("seeds 1 and 2 give the same stream: %x", a)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"github.com/herrfz/coordnode/app"
+	"github.com/herrfz/coordnode/config"
+	"github.com/herrfz/coordnode/energy"
+	"github.com/herrfz/coordnode/radio"
+	"github.com/herrfz/coordnode/rng"
+	"github.com/herrfz/coordnode/serialport"
+	"github.com/herrfz/coordnode/transport"
+	"github.com/herrfz/coordnode/worker"
+	"os"
+	"time"
+)
+
+type node struct {
+	app    app.App
+	device serialport.Config
+	config worker.NodeConfig
+}
+
+// scenario files may use every registered app
+func init() {
+	config.AppTypes = app.Names()
+}
+
+var defaultPAN = []byte{0xb1, 0xca}
+
+func makeNodeConfig(addr int, eui []byte, secure bool) worker.NodeConfig {
+	nodeAddr := make([]byte, 2)
+	binary.LittleEndian.PutUint16(nodeAddr, uint16(addr))
+	return worker.NodeConfig{
+		Addr:    nodeAddr,
+		EUI:     eui,
+		PAN:     defaultPAN,
+		Secure:  secure,
+		Link:    worker.StaticLink{},
+		Ack:     worker.DefaultAck,
+		Rand:    rng.New(),
+		AppRand: rng.New(),
+	}
+}
+
+// nodes given on the command line, numbered sequentially; every forward
+// device gets its own node
+func nodesFromFlags(nJamming, nSensors int, fwdDevices []serialport.Config, secure bool, oui []byte) map[int]node {
+	mapNodes := make(map[int]node)
+	for i := 0; i < nJamming; i++ {
+		mapNodes[i] = node{&app.Jamming{}, serialport.Config{}, makeNodeConfig(i, worker.MakeEUI64(oui, uint16(i)), secure)}
+	}
+	for i := nJamming; i < nJamming+nSensors; i++ {
+		sensor, _ := app.NewSensor(nil) // the defaults are valid
+		mapNodes[i] = node{sensor, serialport.Config{}, makeNodeConfig(i, worker.MakeEUI64(oui, uint16(i)), secure)}
+	}
+	for j, device := range fwdDevices {
+		i := nJamming + nSensors + j
+		mapNodes[i] = node{&app.Forwarder{}, device, makeNodeConfig(i, worker.MakeEUI64(oui, uint16(i)), secure)}
+	}
+	return mapNodes
+}
+
+// nodes described in a scenario file, which has been validated on load
+func nodesFromConfig(cfg *config.Config, oui []byte) (map[int]node, error) {
+	pan := defaultPAN
+	if cfg.Coordinator.PAN != nil {
+		pan = cfg.Coordinator.PAN
+	}
+
+	var medium *radio.Medium
+	if len(cfg.Jammers) > 0 || cfg.Radio != nil {
+		jammers := make([]radio.Jammer, len(cfg.Jammers))
+		for i, j := range cfg.Jammers {
+			start, stop, _ := j.Schedule()
+			jammers[i] = radio.Jammer{Position: point(j.Position), Power: j.Power,
+				Start: start, Stop: stop, Slots: j.Slots, Corrupt: j.Corrupt}
+		}
+		medium = radio.NewMedium(jammers)
+		if r := cfg.Radio; r != nil {
+			medium.Propagation, medium.Coordinator = propagation(*r), point(r.Coordinator)
+		}
+	}
+
+	var channel *radio.Channel
+	if c := cfg.Channel; c != nil {
+		slotLength, _ := c.SlotLength()
+		channel = radio.NewChannel(slotLength, c.Slots)
+	}
+
+	mapNodes := make(map[int]node)
+	euis := make(map[string]int) // generated ones included, they may collide with given ones
+	for _, n := range cfg.Nodes {
+		eui := []byte(n.EUI64)
+		if eui == nil {
+			eui = worker.MakeEUI64(oui, uint16(n.Address))
+		}
+		if addr, ok := euis[string(eui)]; ok {
+			return nil, fmt.Errorf("node %d: eui64 %x already used by node %d", n.Address, eui, addr)
+		}
+		euis[string(eui)] = n.Address
+
+		nodeConfig := makeNodeConfig(n.Address, eui, n.Security != "none")
+		nodeConfig.PAN = pan
+		if n.Security == "enc" {
+			nodeConfig.ULPolicy = 0x01
+		}
+		nodeConfig.Keys = worker.Keys{NIK: n.Keys.NIK, S: n.Keys.S, AK: n.Keys.AK, SIK: n.Keys.SIK, SCK: n.Keys.SCK}
+		link := worker.StaticLink{LQI: byte(n.Link.LQI), ED: byte(n.Link.ED), Loss: n.Link.Loss}
+		switch {
+		case cfg.Radio != nil && (n.Link.Position != nil || n.Link.Mobility != ""):
+			tx := radio.Transmitter{Power: n.Link.Power, Position: point(n.Link.Position), Slot: n.Link.Slot,
+				Shadow: medium.Propagation.Shadow()}
+			if n.Link.Mobility != "" {
+				trace, err := loadTrace(n.Link.Mobility)
+				if err != nil {
+					return nil, fmt.Errorf("node %d: link.mobility: %s", n.Address, err.Error())
+				}
+				tx.Mobility = &trace
+			}
+			nodeConfig.Link = worker.RadioLink{Medium: medium, Node: tx, Loss: n.Link.Loss}
+		case medium != nil:
+			nodeConfig.Link = worker.JammedLink{StaticLink: link, Medium: medium, Position: point(n.Link.Position), Slot: n.Link.Slot}
+		default:
+			nodeConfig.Link = link
+		}
+
+		nodeConfig.Channel = channel
+
+		nodeConfig.Ack.Uplink, nodeConfig.Ack.Loss = n.Link.Ack.Uplink, n.Link.Ack.Loss
+		if n.Link.Ack.Retries != nil {
+			nodeConfig.Ack.Retries = *n.Link.Ack.Retries
+		}
+		if n.Link.Ack.Backoff != "" {
+			nodeConfig.Ack.Backoff, _ = time.ParseDuration(n.Link.Ack.Backoff)
+		}
+
+		if n.Sleep != nil {
+			nodeConfig.Sleep.Poll, nodeConfig.Sleep.Persistence, _ = n.Sleep.Durations()
+		}
+		if n.Battery != nil {
+			nodeConfig.Energy = meter(*n.Battery, n.Sleep != nil)
+		}
+
+		device := serialport.Config{}
+		if n.App.Type == "forward" {
+			p, _ := n.App.ForwardParams()
+			device, _ = p.Port(config.ForwardPort)
+		}
+
+		a, err := app.New(n.App.Type, n.App.Params)
+		if err != nil {
+			return nil, fmt.Errorf("node %d: %s", n.Address, err.Error())
+		}
+		mapNodes[n.Address] = node{a, device, nodeConfig}
+	}
+	return mapNodes, nil
+}
+
+// energy model from a scenario file, with the defaults for what is not given
+func meter(b config.Battery, sleepy bool) *energy.Meter {
+	battery := energy.DefaultBattery
+	if b.Capacity != 0 {
+		battery.Capacity = b.Capacity
+	}
+	if b.Full != 0 {
+		battery.Full = b.Full
+	}
+	if b.Empty != 0 {
+		battery.Empty = b.Empty
+	}
+
+	costs := energy.DefaultCosts
+	for name, cost := range b.Costs {
+		switch name {
+		case "tx":
+			costs.TX = cost
+		case "rx":
+			costs.RX = cost
+		case "ecdh":
+			costs.ECDH = cost
+		case "aes":
+			costs.AES = cost
+		case "hmac":
+			costs.HMAC = cost
+		case "sleep":
+			costs.Sleep = cost
+		case "listen":
+			costs.Listen = cost
+		}
+	}
+	return energy.NewMeter(battery, costs, sleepy)
+}
+
+// propagation model from a scenario file, free space for what is not given
+func propagation(r config.Radio) radio.Propagation {
+	p := radio.FreeSpace
+	if r.RefLoss != nil {
+		p.RefLoss = *r.RefLoss
+	}
+	if r.RefDistance != 0 {
+		p.RefDistance = r.RefDistance
+	}
+	if r.Exponent != 0 {
+		p.Exponent = r.Exponent
+	}
+	p.Shadowing = r.Shadowing
+	for _, w := range r.Walls {
+		p.Walls = append(p.Walls, radio.Wall{A: radio.Point{X: w.From[0], Y: w.From[1]},
+			B: radio.Point{X: w.To[0], Y: w.To[1]}, Attenuation: w.Attenuation})
+	}
+	return p
+}
+
+func loadTrace(path string) (radio.Trace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return radio.Trace{}, err
+	}
+	defer f.Close()
+	return radio.ParseTrace(f)
+}
+
+// position from a scenario file, the origin if not given
+func point(xyz []float64) radio.Point {
+	if len(xyz) != 3 {
+		return radio.Point{}
+	}
+	return radio.Point{X: xyz[0], Y: xyz[1], Z: xyz[2]}
+}
+
+// real node behind the node serial interface
+type passthroughNode struct {
+	link transport.Endpoint
+	addr int // -1 if the address is not known
+}
+
+// data requests for the real node: those sent to its address, or, if it is not
+// known, all requests not sent to an emulated node
+func (p passthroughNode) accepts(mapNodes map[int]node) func(dstAddr []byte) bool {
+	if p.addr >= 0 {
+		addr := make([]byte, 2)
+		binary.LittleEndian.PutUint16(addr, uint16(p.addr))
+		return func(dstAddr []byte) bool {
+			return bytes.Equal(dstAddr, addr)
+		}
+	}
+
+	return func(dstAddr []byte) bool {
+		for _, n := range mapNodes {
+			if bytes.Equal(dstAddr, n.config.Addr) || bytes.Equal(dstAddr, worker.FrameAddr(n.config.EUI)) {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,164 @@
+// This package describes and opens the serial ports used by the emulator
+package serialport
+
+import (
+	"fmt"
+	"github.com/tarm/goserial"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// rates accepted by the serial driver
+var BaudRates = []int{50, 75, 110, 134, 150, 200, 300, 600, 1200, 1800, 2400, 4800, 9600,
+	19200, 38400, 57600, 115200, 230400, 460800, 500000, 576000, 921600, 1000000,
+	1152000, 1500000, 2000000, 2500000, 3000000, 3500000, 4000000}
+
+type Config struct {
+	Name        string
+	Baud        int
+	Parity      byte          // 'N', 'E' or 'O', the serial driver has no mark or space parity
+	StopBits    byte          // 1 or 2, the serial driver has no one and a half
+	ReadTimeout time.Duration // poll interval of the driver, zero blocks; Open reads until data arrives either way
+}
+
+// port with the given rate, no parity, one stop bit and blocking reads
+func Default(name string, baud int) Config {
+	return Config{Name: name, Baud: baud, Parity: 'N', StopBits: 1}
+}
+
+// parse a port given as "device[?baud=N&parity=N|E|O&stop=1|2&timeout=D]",
+// missing parameters are taken from the default
+func ParseSpec(spec string, def Config) (Config, error) {
+	c := def
+	c.Name = spec
+	query := ""
+	if i := strings.Index(spec, "?"); i >= 0 {
+		c.Name, query = spec[:i], spec[i+1:]
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return c, fmt.Errorf("%q: %s", spec, err.Error())
+	}
+	for key := range params {
+		value := params.Get(key)
+		switch key {
+		case "baud":
+			c.Baud, err = strconv.Atoi(value)
+		case "parity":
+			c.Parity, err = ParseParity(value)
+		case "stop":
+			c.StopBits, err = ParseStopBits(value)
+		case "timeout":
+			c.ReadTimeout, err = time.ParseDuration(value)
+		default:
+			err = fmt.Errorf("unknown parameter %q", key)
+		}
+		if err != nil {
+			return c, fmt.Errorf("%q: %s", spec, err.Error())
+		}
+	}
+
+	if err := c.Validate(); err != nil {
+		return c, fmt.Errorf("%q: %s", spec, err.Error())
+	}
+	return c, nil
+}
+
+// parse a comma separated list of ports
+func ParseList(specs string, def Config) ([]Config, error) {
+	var list []Config
+	for _, spec := range strings.Split(specs, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "" {
+			continue
+		}
+		c, err := ParseSpec(spec, def)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, c)
+	}
+	return list, nil
+}
+
+func ParseParity(s string) (byte, error) {
+	if len(s) != 1 || !strings.Contains("NEO", strings.ToUpper(s)) {
+		return 0, fmt.Errorf("invalid parity %q, expected N, E or O", s)
+	}
+	return strings.ToUpper(s)[0], nil
+}
+
+func ParseStopBits(s string) (byte, error) {
+	switch s {
+	case "1":
+		return 1, nil
+	case "2":
+		return 2, nil
+	}
+	return 0, fmt.Errorf("invalid stop bits %q, expected 1 or 2", s)
+}
+
+func (c Config) Validate() error {
+	if c.Name == "" {
+		return fmt.Errorf("no device given")
+	}
+
+	validBaud := false
+	for _, b := range BaudRates {
+		validBaud = validBaud || c.Baud == b
+	}
+	if !validBaud {
+		return fmt.Errorf("unsupported baud rate %d", c.Baud)
+	}
+
+	if _, err := ParseParity(string(c.Parity)); err != nil {
+		return err
+	}
+	if c.StopBits != 1 && c.StopBits != 2 {
+		return fmt.Errorf("invalid stop bits %d", c.StopBits)
+	}
+	if c.ReadTimeout < 0 {
+		return fmt.Errorf("negative read timeout %v", c.ReadTimeout)
+	}
+	return nil
+}
+
+func (c Config) String() string {
+	return fmt.Sprintf("%s@%d,8%c%d", c.Name, c.Baud, c.Parity, c.StopBits)
+}
+
+func Open(c Config) (io.ReadWriteCloser, error) {
+	port, err := serial.OpenPort(&serial.Config{
+		Name:        c.Name,
+		Baud:        c.Baud,
+		Parity:      serial.Parity(c.Parity),
+		StopBits:    serial.StopBits(c.StopBits),
+		ReadTimeout: c.ReadTimeout,
+	})
+	if err != nil || c.ReadTimeout == 0 {
+		return port, err
+	}
+	return timeoutPort{port, c.ReadTimeout}, nil
+}
+
+// with a read timeout the driver returns io.EOF when no data came in time; the
+// readers of the emulator block, so that is no data and the read goes on. an
+// EOF well before the timeout, e.g. on a hang up, is returned
+type timeoutPort struct {
+	io.ReadWriteCloser
+	timeout time.Duration
+}
+
+func (p timeoutPort) Read(buf []byte) (int, error) {
+	for {
+		start := time.Now()
+		n, err := p.ReadWriteCloser.Read(buf)
+		if n > 0 || err != io.EOF || time.Since(start) < p.timeout/2 {
+			return n, err
+		}
+	}
+}
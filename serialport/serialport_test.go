@@ -0,0 +1,75 @@
+package serialport
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestParseSpec(t *testing.T) {
+	def := Default("", 57600)
+
+	c, err := ParseSpec("/dev/ttyUSB1", def)
+	if err != nil || c != Default("/dev/ttyUSB1", 57600) {
+		t.Errorf("wrong output: %v, %v", c, err)
+	}
+
+	c, err = ParseSpec("/dev/ttyUSB1?baud=115200&parity=e&stop=2&timeout=100ms", def)
+	out := Config{Name: "/dev/ttyUSB1", Baud: 115200, Parity: 'E', StopBits: 2, ReadTimeout: 100 * time.Millisecond}
+	if err != nil || c != out {
+		t.Errorf("wrong output: %v, %v, expected: %v", c, err, out)
+	}
+
+	for _, spec := range []string{"", "?baud=9600", "/dev/ttyUSB1?baud=fast", "/dev/ttyUSB1?baud=12345",
+		"/dev/ttyUSB1?speed=9600", "/dev/ttyUSB1?parity=X", "/dev/ttyUSB1?stop=3", "/dev/ttyUSB1?timeout=-1s",
+		"/dev/ttyUSB1?parity=M", "/dev/ttyUSB1?parity=S", "/dev/ttyUSB1?stop=1.5"} { // not opened by the serial driver
+		if _, err := ParseSpec(spec, def); err == nil {
+			t.Errorf("no error parsing %q", spec)
+		}
+	}
+}
+
+func TestParseList(t *testing.T) {
+	list, err := ParseList("/dev/ttyUSB1, /dev/ttyUSB2?baud=9600,", Default("", 57600))
+	if err != nil {
+		t.Fatalf("error parsing: %v", err.Error())
+	}
+	out := []Config{Default("/dev/ttyUSB1", 57600), Default("/dev/ttyUSB2", 9600)}
+	if len(list) != len(out) || list[0] != out[0] || list[1] != out[1] {
+		t.Errorf("wrong output: %v, expected: %v", list, out)
+	}
+}
+
+// port returning io.EOF once after the read timeout, then its data
+type idlePort struct {
+	idle    bool
+	timeout time.Duration
+	data    *bytes.Reader
+}
+
+func (p *idlePort) Read(buf []byte) (int, error) {
+	if p.idle {
+		p.idle = false
+		time.Sleep(p.timeout)
+		return 0, io.EOF
+	}
+	return p.data.Read(buf)
+}
+
+func (p *idlePort) Write(buf []byte) (int, error) { return len(buf), nil }
+func (p *idlePort) Close() error                  { return nil }
+
+func TestTimeoutPort(t *testing.T) {
+	port := timeoutPort{&idlePort{true, 10 * time.Millisecond, bytes.NewReader([]byte{0x42})}, 10 * time.Millisecond}
+	buf := make([]byte, 1)
+	if _, err := io.ReadFull(port, buf); err != nil || buf[0] != 0x42 {
+		t.Errorf("wrong output: %x, %v, expected: 42", buf, err)
+	}
+
+	// an EOF before the timeout is one
+	port = timeoutPort{&idlePort{true, 0, bytes.NewReader([]byte{})}, 10 * time.Millisecond}
+	if _, err := port.Read(buf); err != io.EOF {
+		t.Errorf("wrong output: %v, expected: %v", err, io.EOF)
+	}
+}
@@ -0,0 +1,70 @@
+package transport
+
+import (
+	"fmt"
+	"github.com/herrfz/coordnode/pty"
+	"io/ioutil"
+	"sync"
+	"time"
+)
+
+// pseudo-terminals by path file, or by endpoint without one, created on the
+// first open and kept until the emulator exits, so the peer keeps its device
+// across reconnects
+var ptys = map[ptyKey]*pty.Pair{}
+var ptyMutex = &sync.Mutex{}
+var lastPtyID = 0
+
+type ptyKey struct {
+	pathFile string
+	id       int
+}
+
+func newPtyID() int {
+	ptyMutex.Lock()
+	defer ptyMutex.Unlock()
+	lastPtyID++
+	return lastPtyID
+}
+
+// ptyConn is one use of a pseudo-terminal; closing it ends a pending read but
+// keeps the pair
+type ptyConn struct {
+	*pty.Pair
+}
+
+func (c ptyConn) Read(buf []byte) (int, error) {
+	return c.Master.Read(buf)
+}
+
+func (c ptyConn) Write(buf []byte) (int, error) {
+	return c.Master.Write(buf)
+}
+
+func (c ptyConn) Close() error {
+	return c.Master.SetReadDeadline(time.Now())
+}
+
+func openPty(key ptyKey) (ptyConn, error) {
+	ptyMutex.Lock()
+	defer ptyMutex.Unlock()
+
+	p, ok := ptys[key]
+	if !ok {
+		var err error
+		if p, err = pty.Open(); err != nil {
+			return ptyConn{}, err
+		}
+		if key.pathFile != "" {
+			if err := ioutil.WriteFile(key.pathFile, []byte(p.Peer+"\n"), 0644); err != nil {
+				p.Close()
+				return ptyConn{}, err
+			}
+		}
+		fmt.Println("pseudo-terminal created, connect the peer to", p.Peer)
+		ptys[key] = p
+	}
+
+	p.Master.SetReadDeadline(time.Time{})
+	return ptyConn{p}, nil
+}
@@ -0,0 +1,256 @@
+// This package opens serial links, to the wdc or a real node, over a serial
+// port, a socket or a pseudo-terminal
+package transport
+
+import (
+	"fmt"
+	"github.com/herrfz/coordnode/serialport"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// link schemes; the -listen variants wait for the peer to connect
+var Schemes = []string{"serial", "tcp", "tcp-listen", "udp", "unix", "unix-listen", "pty"}
+
+// delay before reconnecting a lost socket, doubled on every failed attempt
+const (
+	RECONNECT_MIN = 1 * time.Second
+	RECONNECT_MAX = 30 * time.Second
+)
+
+type Endpoint struct {
+	Scheme string
+	Addr   string            // host:port, socket path or file for the pty device path
+	Serial serialport.Config // serial scheme only
+	ptyID  int               // pty scheme without path, every parsed one gets its own pair
+}
+
+// endpoint of a serial port
+func Serial(c serialport.Config) Endpoint {
+	return Endpoint{Scheme: "serial", Serial: c}
+}
+
+// parse an endpoint given as URL:
+//
+//	serial:///dev/ttyUSB0?baud=57600   serial port, parameters as in serialport.ParseSpec
+//	/dev/ttyUSB0?baud=57600            the same, without scheme
+//	tcp://host:port                    TCP client
+//	tcp-listen://[host]:port           TCP server, one peer at a time
+//	udp://host:port                    UDP, one message per datagram
+//	unix:///path                       Unix socket client
+//	unix-listen:///path                Unix socket server, one peer at a time
+//	pty://[/path]                      pseudo-terminal pair, the peer device is printed
+//	                                   and written to the file at path, if given
+//
+// missing serial parameters are taken from the default
+func Parse(spec string, def serialport.Config) (Endpoint, error) {
+	i := strings.Index(spec, "://")
+	if i < 0 {
+		c, err := serialport.ParseSpec(spec, def)
+		return Serial(c), err
+	}
+
+	e := Endpoint{Scheme: spec[:i], Addr: spec[i+3:]}
+	switch e.Scheme {
+	case "serial":
+		c, err := serialport.ParseSpec(e.Addr, def)
+		return Serial(c), err
+
+	case "tcp", "tcp-listen", "udp":
+		if _, _, err := net.SplitHostPort(e.Addr); err != nil {
+			return e, fmt.Errorf("%q: %s", spec, err.Error())
+		}
+
+	case "unix", "unix-listen":
+		if e.Addr == "" {
+			return e, fmt.Errorf("%q: no socket path given", spec)
+		}
+
+	case "pty": // path optional
+		if e.Addr == "" {
+			e.ptyID = newPtyID()
+		}
+
+	default:
+		return e, fmt.Errorf("%q: unknown scheme %q, expected one of %s", spec, e.Scheme, strings.Join(Schemes, ", "))
+	}
+	return e, nil
+}
+
+func (e Endpoint) String() string {
+	if e.Scheme == "serial" {
+		return "serial://" + e.Serial.String()
+	}
+	return e.Scheme + "://" + e.Addr
+}
+
+// Open the endpoint. sockets are (re)connected in the background: reads wait
+// for a connection, writes fail while there is none
+func (e Endpoint) Open() (io.ReadWriteCloser, error) {
+	switch e.Scheme {
+	case "serial":
+		return serialport.Open(e.Serial)
+
+	case "tcp", "udp", "unix":
+		return newStream(e.String(), func() (net.Conn, error) {
+			return net.Dial(e.Scheme, e.Addr)
+		}, nil), nil
+
+	case "tcp-listen", "unix-listen":
+		network := strings.TrimSuffix(e.Scheme, "-listen")
+		if network == "unix" {
+			removeStaleSocket(e.Addr)
+		}
+		l, err := net.Listen(network, e.Addr)
+		if err != nil {
+			return nil, err
+		}
+		return newStream(e.String(), l.Accept, l), nil
+
+	case "pty":
+		return openPty(ptyKey{e.Addr, e.ptyID})
+	}
+	return nil, fmt.Errorf("unknown scheme %q", e.Scheme)
+}
+
+// a socket left behind by an earlier run prevents listening, other files are kept
+func removeStaleSocket(path string) {
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+}
+
+// stream is a socket that is connected again whenever it fails, so a
+// restarted peer is picked up without restarting the emulator
+type stream struct {
+	name     string
+	connect  func() (net.Conn, error)
+	listener io.Closer // server only
+
+	mutex   sync.Mutex // protect conn, written by the reader and used by writers
+	conn    net.Conn   // nil while disconnected
+	closed  bool
+	closeCh chan bool
+	backoff time.Duration
+}
+
+func newStream(name string, connect func() (net.Conn, error), listener io.Closer) *stream {
+	return &stream{name: name, connect: connect, listener: listener, closeCh: make(chan bool)}
+}
+
+func (s *stream) Read(buf []byte) (int, error) {
+	for {
+		conn, err := s.get()
+		if err != nil {
+			return 0, err
+		}
+
+		n, err := conn.Read(buf)
+		if n > 0 || err == nil {
+			s.backoff = 0
+			return n, nil
+		}
+		if s.drop(conn, err) {
+			return 0, io.EOF
+		}
+	}
+}
+
+func (s *stream) Write(buf []byte) (int, error) {
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+	if conn == nil {
+		return 0, fmt.Errorf("%s not connected", s.name)
+	}
+	return conn.Write(buf)
+}
+
+func (s *stream) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	close(s.closeCh)
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	if s.conn != nil {
+		return s.conn.Close()
+	}
+	return nil
+}
+
+// current connection, connecting with backoff if there is none; only called
+// by the reader
+func (s *stream) get() (net.Conn, error) {
+	s.mutex.Lock()
+	conn := s.conn
+	s.mutex.Unlock()
+
+	for conn == nil {
+		if s.backoff > 0 {
+			select {
+			case <-time.After(s.backoff):
+			case <-s.closeCh:
+				return nil, io.EOF
+			}
+		}
+		s.backoff *= 2
+		if s.backoff < RECONNECT_MIN {
+			s.backoff = RECONNECT_MIN
+		}
+		if s.backoff > RECONNECT_MAX {
+			s.backoff = RECONNECT_MAX
+		}
+
+		c, err := s.connect()
+		if err != nil {
+			if s.isClosed() {
+				return nil, io.EOF
+			}
+			fmt.Println("error connecting", s.name+":", err.Error(), "retry in", s.backoff)
+			continue
+		}
+
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			c.Close()
+			return nil, io.EOF
+		}
+		s.conn = c
+		s.mutex.Unlock()
+		fmt.Println("connected", s.name, "peer", c.RemoteAddr())
+		conn = c
+	}
+	return conn, nil
+}
+
+// forget a failed connection, true if the stream is closed
+func (s *stream) drop(conn net.Conn, err error) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return true
+	}
+	fmt.Println("lost", s.name+":", err.Error())
+	conn.Close()
+	s.conn = nil
+	if s.backoff == 0 {
+		s.backoff = RECONNECT_MIN
+	}
+	return false
+}
+
+func (s *stream) isClosed() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.closed
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"bytes"
+	"github.com/herrfz/coordnode/serialport"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var def = serialport.Default("", 57600)
+
+func TestParse(t *testing.T) {
+	valid := []struct {
+		spec string
+		out  Endpoint
+	}{
+		{"/dev/ttyUSB0", Serial(serialport.Default("/dev/ttyUSB0", 57600))},
+		{"serial:///dev/ttyUSB0?baud=9600", Serial(serialport.Default("/dev/ttyUSB0", 9600))},
+		{"tcp://wdc:4000", Endpoint{Scheme: "tcp", Addr: "wdc:4000"}},
+		{"tcp-listen://:4000", Endpoint{Scheme: "tcp-listen", Addr: ":4000"}},
+		{"udp://127.0.0.1:4000", Endpoint{Scheme: "udp", Addr: "127.0.0.1:4000"}},
+		{"unix:///tmp/wdc.sock", Endpoint{Scheme: "unix", Addr: "/tmp/wdc.sock"}},
+	}
+	for _, test := range valid {
+		if e, err := Parse(test.spec, def); err != nil || e != test.out {
+			t.Errorf("wrong output: %+v, %v, expected: %+v", e, err, test.out)
+		}
+	}
+
+	for _, spec := range []string{"", "tcp://wdc", "unix://", "http://wdc:80", "serial://?baud=9600"} {
+		if _, err := Parse(spec, def); err == nil {
+			t.Errorf("no error parsing %q", spec)
+		}
+	}
+}
+
+func TestUnixStream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatalf("error creating directory: %v", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "wdc.sock")
+
+	server, err := Endpoint{Scheme: "unix-listen", Addr: path}.Open()
+	if err != nil {
+		t.Fatalf("error listening: %v", err.Error())
+	}
+	defer server.Close()
+	client, _ := Endpoint{Scheme: "unix", Addr: path}.Open()
+	defer client.Close()
+
+	rx := make(chan []byte)
+	go func() {
+		buf := make([]byte, 16)
+		n, _ := server.Read(buf)
+		rx <- buf[:n]
+	}()
+	go client.Read(make([]byte, 16)) // connects the client
+
+	msg := []byte{0x01, 0x01}
+	for i := 0; ; i++ {
+		if _, err := client.Write(msg); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("client not connected")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	select {
+	case buf := <-rx:
+		if !bytes.Equal(buf, msg) {
+			t.Errorf("wrong output: %v, expected: %v", buf, msg)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("nothing received")
+	}
+}
+
+func TestPty(t *testing.T) {
+	dir, err := ioutil.TempDir("", "transport")
+	if err != nil {
+		t.Fatalf("error creating directory: %v", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	pathFile := filepath.Join(dir, "wdc.pty")
+
+	e, err := Parse("pty://"+pathFile, def)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err.Error())
+	}
+	link, err := e.Open()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err.Error())
+	}
+
+	path, err := ioutil.ReadFile(pathFile)
+	if err != nil {
+		t.Fatalf("error reading peer path: %v", err.Error())
+	}
+	peer, err := os.OpenFile(string(bytes.TrimSpace(path)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("error opening peer: %v", err.Error())
+	}
+	defer peer.Close()
+
+	// closing ends the pending read, reopening gives the same pair
+	done := make(chan error)
+	go func() {
+		_, err := link.Read(make([]byte, 16))
+		done <- err
+	}()
+	link.Close()
+	if err := <-done; err == nil {
+		t.Errorf("read not ended by close")
+	}
+
+	link, _ = e.Open()
+	defer link.Close()
+	peer.Write([]byte{0x01, 0x01})
+	buf := make([]byte, 16)
+	if n, err := link.Read(buf); err != nil || !bytes.Equal(buf[:n], []byte{0x01, 0x01}) {
+		t.Errorf("wrong output: %v, %v", buf[:n], err)
+	}
+}
+
+// bare pty links, e.g. to the wdc and to a node, get a pair each
+func TestPtyBare(t *testing.T) {
+	wdc, _ := Parse("pty://", def)
+	node, _ := Parse("pty://", def)
+	a, err := wdc.Open()
+	if err != nil {
+		t.Skipf("no pseudo-terminals: %v", err.Error())
+	}
+	defer a.Close()
+	b, err := node.Open()
+	if err != nil {
+		t.Fatalf("error opening: %v", err.Error())
+	}
+	defer b.Close()
+	if a.(ptyConn).Peer == b.(ptyConn).Peer {
+		t.Errorf("both links on %v", a.(ptyConn).Peer)
+	}
+
+	// reopening gives the same pair
+	if c, _ := wdc.Open(); c.(ptyConn).Peer != a.(ptyConn).Peer {
+		t.Errorf("wrong output: %v, expected: %v", c.(ptyConn).Peer, a.(ptyConn).Peer)
+	}
+}
@@ -0,0 +1,55 @@
+package worker
+
+import (
+	"github.com/herrfz/coordnode/rng"
+	"time"
+)
+
+// status of WDC_MAC_DATA_CON, cf. IEEE 802.15.4 MAC enumerations
+const (
+	MAC_SUCCESS           = 0x00
+	MAC_INVALID_PARAMETER = 0xe8
+	MAC_NO_ACK            = 0xe9
+)
+
+// MAC acknowledgements between a node and the coordinator: downlinks are
+// acknowledged by the node if the wdc requests it, uplinks by the coordinator
+// if Uplink is set. a frame that is not acknowledged is retransmitted up to
+// Retries times
+type AckModel struct {
+	Uplink  bool
+	Loss    float64       // probability of losing an acknowledgement
+	Retries int           // macMaxFrameRetries
+	Backoff time.Duration // longest wait before the first retransmission, doubled on each one
+}
+
+var DefaultAck = AckModel{Retries: 3, Backoff: 10 * time.Millisecond}
+
+func (a AckModel) lost(r *rng.Rand) bool {
+	return a.Loss > 0 && r.Float64() < a.Loss
+}
+
+// random wait before a retransmission, attempt counted from 0
+func (a AckModel) wait(r *rng.Rand, attempt int) time.Duration {
+	if a.Backoff <= 0 {
+		return 0
+	}
+	return time.Duration(r.Int63n(int64(a.Backoff) << uint(attempt)))
+}
+
+// MAC acknowledgement frame, FCF frame type ack
+func MakeAckFrame(seq byte) []byte {
+	return []byte{0x02, 0x00, seq, 0xde, 0xad} // fake MFR
+}
+
+// WDC_MAC_DATA_CON for the data request with the given handle
+func MakeDataCon(handle, status byte) []byte {
+	return []byte{0x03, 0x18, handle, status}
+}
+
+// whether the confirmation of a data request waits for the acknowledgement by
+// the node, i.e. it requests one and is not broadcast
+func AckRequested(buf []byte) bool {
+	req := WDC_REQ{}
+	return req.ParseWDCReq(buf) == nil && req.ACKREQ
+}
@@ -0,0 +1,118 @@
+package worker
+
+import (
+	"context"
+	"fmt"
+	"github.com/herrfz/coordnode/app"
+	"github.com/herrfz/coordnode/rng"
+	"github.com/herrfz/coordnode/serialport"
+)
+
+// nodeContext is the node as seen by its app, on the app channels of DoDataRequest
+type nodeContext struct {
+	ctx     context.Context
+	node    NodeConfig
+	session *Session
+	device  serialport.Config
+	appUlCh chan []byte
+	crossCh chan []byte
+}
+
+func (n *nodeContext) Node() app.NodeInfo {
+	return app.NodeInfo{Addr: n.node.Addr, EUI: n.node.EUI, PAN: n.node.PAN, Secure: n.node.Secure}
+}
+
+func (n *nodeContext) Keys() app.Keys {
+	k := n.session.Keys()
+	return app.Keys{NIK: k.NIK, S: k.S, AK: k.AK, SIK: k.SIK, SCK: k.SCK}
+}
+
+func (n *nodeContext) Device() serialport.Config {
+	return n.device
+}
+
+func (n *nodeContext) EnergyDetect() byte {
+	return n.node.Link.EnergyDetect()
+}
+
+func (n *nodeContext) LinkCounters() app.LinkCounters {
+	sent, received, ed := n.session.Counters()
+	return app.LinkCounters{Sent: sent, Received: received, ED: ed}
+}
+
+func (n *nodeContext) BatteryVoltage() float64 {
+	if n.node.Energy == nil {
+		return 0
+	}
+	return n.node.Energy.Voltage()
+}
+
+func (n *nodeContext) Rand() *rng.Rand {
+	return n.node.AppRand
+}
+
+func (n *nodeContext) SendUplink(payload []byte) error {
+	select {
+	case n.appUlCh <- payload:
+		return nil
+	case <-n.ctx.Done():
+		return n.ctx.Err()
+	}
+}
+
+func (n *nodeContext) SetNFCData(data []byte) error {
+	select {
+	case n.crossCh <- data:
+		return nil
+	case <-n.ctx.Done():
+		return n.ctx.Err()
+	}
+}
+
+// RunApp runs the app of a node next to DoDataRequest, which must be given the
+// same channels and node.Session: downlinks arriving on appDlCh are passed to
+// OnDownlink, and the app is stopped when appDlCh is closed. appUlCh is closed
+// on return
+func RunApp(a app.App, node NodeConfig, device serialport.Config, appDlCh, appUlCh, crossCh chan []byte) error {
+	defer close(appUlCh)
+	if node.Session == nil {
+		node.Session = NewSession(node.Keys)
+	}
+	if node.Link == nil {
+		node.Link = StaticLink{}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	nc := &nodeContext{ctx, node, node.Session, device, appUlCh, crossCh}
+
+	startErr := make(chan error, 1)
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				startErr <- fmt.Errorf("app panic: %v", r)
+			}
+		}()
+		startErr <- a.Start(ctx, nc)
+	}()
+
+	for {
+		select {
+		case payload, more := <-appDlCh:
+			if !more {
+				cancel()
+				if startErr == nil { // already returned
+					return nil
+				}
+				return <-startErr
+			}
+			a.OnDownlink(payload)
+
+		case err := <-startErr:
+			if err != nil {
+				return err
+			}
+			startErr = nil // app done, downlinks are still taken until stopped
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"github.com/herrfz/coordnode/app"
+	"github.com/herrfz/coordnode/serialport"
+	"testing"
+	"time"
+)
+
+// echoes every downlink as uplink
+type echoApp struct {
+	node app.NodeContext
+	rx   chan []byte
+}
+
+func (e *echoApp) Start(ctx context.Context, node app.NodeContext) error {
+	for {
+		select {
+		case payload := <-e.rx:
+			if err := node.SendUplink(payload); err != nil {
+				return nil
+			}
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+func (e *echoApp) OnDownlink(payload []byte) {
+	e.rx <- payload
+}
+
+func TestRunApp(t *testing.T) {
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca}}
+	node.Session = NewSession(node.Keys)
+
+	appErr, workerErr := make(chan error), make(chan error)
+	go func() {
+		appErr <- RunApp(&echoApp{rx: make(chan []byte, 1)}, node, serialport.Config{}, appDlCh, appUlCh, crossCh)
+	}()
+	go func() { workerErr <- DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh) }()
+
+	dlCh <- []byte{0x0b, 0x17, 0x01, 0x00, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}
+	select {
+	case ind := <-ulCh:
+		if !bytes.Contains(ind, []byte{0x42, 0xde, 0xad}) { // payload and MFR
+			t.Errorf("wrong output: %v, expected uplink of 42", hex.EncodeToString(ind))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no uplink from the app")
+	}
+
+	close(dlCh)
+	for range ulCh {
+	}
+	if err := <-workerErr; err != nil {
+		t.Errorf("worker failed: %v", err.Error())
+	}
+	if err := <-appErr; err != nil {
+		t.Errorf("app failed: %v", err.Error())
+	}
+}
+
+// returns at once
+type oneShotApp struct{}
+
+func (oneShotApp) Start(ctx context.Context, node app.NodeContext) error { return nil }
+func (oneShotApp) OnDownlink(payload []byte)                             {}
+
+func TestRunAppDoneEarly(t *testing.T) {
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca}}
+
+	appErr := make(chan error)
+	go func() { appErr <- RunApp(oneShotApp{}, node, serialport.Config{}, appDlCh, appUlCh, crossCh) }()
+
+	// downlinks are still taken after the app is done
+	time.Sleep(10 * time.Millisecond)
+	appDlCh <- []byte{0x42}
+	close(appDlCh)
+	select {
+	case err := <-appErr:
+		if err != nil {
+			t.Errorf("app failed: %v", err.Error())
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("app not stopped")
+	}
+	if _, more := <-appUlCh; more {
+		t.Errorf("uplink channel not closed")
+	}
+}
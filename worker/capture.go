@@ -0,0 +1,86 @@
+package worker
+
+import (
+	"fmt"
+	"github.com/herrfz/coordnode/clock"
+	"github.com/herrfz/coordnode/pcapng"
+	"github.com/herrfz/coordnode/radio"
+	"io"
+)
+
+// Capture records the wdc messages, and the MPDUs of the data requests and
+// indications among them, to a pcapng file; the fake MFR is left out of the
+// MPDUs, the trailer of the indications gives their LQI and RSS
+type Capture struct {
+	w        *pcapng.Writer
+	wdc, air int // interfaces
+}
+
+func NewCapture(w io.Writer) (*Capture, error) {
+	pw, err := pcapng.NewWriter(w)
+	if err != nil {
+		return nil, err
+	}
+	c := &Capture{w: pw}
+	if c.wdc, err = pw.AddInterface(pcapng.LINKTYPE_USER0, "wdc"); err != nil {
+		return nil, err
+	}
+	if c.air, err = pw.AddInterface(pcapng.LINKTYPE_IEEE802_15_4_TAP, "air"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// message received from the wdc
+func (c *Capture) Inbound(msg []byte) {
+	c.write(c.wdc, msg, pcapng.INBOUND)
+
+	req := WDC_REQ{}
+	if len(msg) > 1 && msg[1] == 0x17 && req.ParseWDCReq(msg) == nil {
+		fcf := []byte{0x01, 0x98} // data, as sent to a real node
+		if req.MACCMD {
+			fcf[0] = 0x03
+		}
+		if req.ACKREQ {
+			fcf[0] |= 0x20
+		}
+		if len(req.DSTADDR) == 8 {
+			fcf[1] |= FCF_DST_LONG
+		}
+		mpdu := MakeMPDU(fcf, req.DSTPAN, req.DSTADDR, []byte{0xff, 0xff}, []byte{0xff, 0xff}, req.MSDU)
+		c.write(c.air, pcapng.TAP(mpdu[:len(mpdu)-2], pcapng.FCSType(0)), pcapng.OUTBOUND)
+	}
+}
+
+// message sent to the wdc
+func (c *Capture) Outbound(msg []byte) {
+	c.write(c.wdc, msg, pcapng.OUTBOUND)
+
+	ind := WDC_IND{}
+	if ind.ParseWDCInd(msg) == nil {
+		mpdu := msg[3 : 3+int(msg[2])-2]
+		lqi, ed := ind.TRAILER[0], ind.TRAILER[1]
+		c.write(c.air, pcapng.TAP(mpdu, pcapng.FCSType(0), pcapng.RSS(radio.PowerFromED(ed)), pcapng.LQI(lqi)), pcapng.INBOUND)
+	}
+}
+
+func (c *Capture) write(iface int, data []byte, direction uint32) {
+	if err := c.w.WritePacket(iface, clock.Now(), data, direction); err != nil {
+		fmt.Println("capture failed:", err.Error())
+	}
+}
+
+// writer to the wdc recording every message written, one per call
+func (c *Capture) Writer(w io.Writer) io.Writer {
+	return captureWriter{c, w}
+}
+
+type captureWriter struct {
+	c *Capture
+	w io.Writer
+}
+
+func (cw captureWriter) Write(msg []byte) (int, error) {
+	cw.c.Outbound(msg)
+	return cw.w.Write(msg)
+}
@@ -0,0 +1,42 @@
+package worker
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCapture(t *testing.T) {
+	out := &bytes.Buffer{}
+	c, err := NewCapture(out)
+	if err != nil {
+		t.Fatalf("error creating capture: %v", err.Error())
+	}
+	header := out.Len()
+
+	// the message, then its MPDU without the MFR
+	c.Writer(&bytes.Buffer{}).Write(linkStatusInd)
+	mpdu := linkStatusInd[3 : len(linkStatusInd)-7]
+	captured := out.Bytes()[header:]
+	if !bytes.Contains(captured, linkStatusInd) || bytes.Count(captured, mpdu) != 2 {
+		t.Errorf("wrong output: %x, expected the indication %x then the MPDU %x", captured, linkStatusInd, mpdu)
+	}
+
+	// an indication of the serial passthrough, with its longer trailer
+	out.Reset()
+	mpdu = MakeMPDU([]byte{0x01, 0x98}, []byte{0xb1, 0xca}, []byte{0x01, 0x00}, []byte{0xff, 0xff}, []byte{0xff, 0xff}, []byte{0xca, 0xfe})
+	c.Outbound(MakeWDCInd(mpdu, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}))
+	if bytes.Count(out.Bytes(), mpdu[:len(mpdu)-2]) != 2 {
+		t.Errorf("wrong output: %x, expected the indication then the MPDU %x", out.Bytes(), mpdu[:len(mpdu)-2])
+	}
+
+	// a data request sent to a node, its MPDU with our MHR
+	out.Reset()
+	req := []byte{0x0b, 0x17, 0x2a, ACK_REQUESTED, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}
+	c.Inbound(req)
+	if mpdu := []byte{0x21, 0x98, 0x00, 0xb1, 0xca, 0x01, 0x00, 0xff, 0xff, 0xff, 0xff, 0x09, 0x42}; !bytes.Contains(out.Bytes(), mpdu) {
+		t.Errorf("wrong output: %x, expected to contain: %x", out.Bytes(), mpdu)
+	}
+	if !bytes.Equal(req, []byte{0x0b, 0x17, 0x2a, ACK_REQUESTED, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}) {
+		t.Errorf("request modified: %x", req)
+	}
+}
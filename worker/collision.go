@@ -0,0 +1,25 @@
+package worker
+
+import (
+	"github.com/herrfz/coordnode/rng"
+	"sync/atomic"
+)
+
+// set while the wdc runs TDMA, read by the node workers
+var tdmaRunning int32
+
+func TDMARunning() bool {
+	return atomic.LoadInt32(&tdmaRunning) == 1
+}
+
+// whether an uplink is lost in a collision with the uplinks of other nodes on
+// the shared channel; returns once the frame has been sent, in the slot of the
+// node if TDMA is running
+func (node NodeConfig) collided(r *rng.Rand, IND []byte) bool {
+	if node.Channel == nil {
+		return false
+	}
+	power, slot := node.Link.Signal()
+	others, survive := node.Channel.Transmit(int(IND[2]), power, slot, TDMARunning())
+	return others > 0 && r.Float64() >= survive
+}
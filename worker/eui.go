@@ -0,0 +1,43 @@
+package worker
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// EUI-64 addresses are kept in canonical (big endian) order, as printed on
+// the device label; frames carry them in reverse byte order like every other
+// 802.15.4 address field
+
+// generate a deterministic EUI-64 for an emulated node: OUI, three zero
+// bytes, and the short address
+func MakeEUI64(oui []byte, addr uint16) []byte {
+	eui := make([]byte, 8)
+	copy(eui[:3], oui)
+	binary.BigEndian.PutUint16(eui[6:], addr)
+	return eui
+}
+
+// parse an EUI-64 given as 16 hex digits, optionally separated by ':' or '-'
+func ParseEUI64(s string) ([]byte, error) {
+	s = strings.NewReplacer(":", "", "-", "").Replace(s)
+	eui, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid EUI-64 %q: %s", s, err.Error())
+	}
+	if len(eui) != 8 {
+		return nil, fmt.Errorf("invalid EUI-64 %q: must be 8 bytes", s)
+	}
+	return eui, nil
+}
+
+// byte order of the EUI-64 as it appears in a frame address field
+func FrameAddr(eui []byte) []byte {
+	addr := make([]byte, len(eui))
+	for i := range eui {
+		addr[i] = eui[len(eui)-1-i]
+	}
+	return addr
+}
@@ -0,0 +1,37 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+func TestMakeEUI64(t *testing.T) {
+	eui := MakeEUI64([]byte{0x02, 0x00, 0x00}, 0x0102)
+	out := []byte{0x02, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x02}
+	if !bytes.Equal(eui, out) {
+		t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(eui), hex.EncodeToString(out))
+	}
+
+	frameAddr := []byte{0x02, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02}
+	if addr := FrameAddr(eui); !bytes.Equal(addr, frameAddr) {
+		t.Errorf("wrong frame address: %v, expected: %v", hex.EncodeToString(addr), hex.EncodeToString(frameAddr))
+	}
+}
+
+func TestParseEUI64(t *testing.T) {
+	eui, err := ParseEUI64("00:12:4b:00:06:0d:9f:aa")
+	if err != nil {
+		t.Errorf("error parsing: %v", err.Error())
+	}
+	out := []byte{0x00, 0x12, 0x4b, 0x00, 0x06, 0x0d, 0x9f, 0xaa}
+	if !bytes.Equal(eui, out) {
+		t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(eui), hex.EncodeToString(out))
+	}
+
+	for _, s := range []string{"00124b", "zz124b00060d9faa", "00124b00060d9faa00"} {
+		if _, err := ParseEUI64(s); err == nil {
+			t.Errorf("no error parsing %v", s)
+		}
+	}
+}
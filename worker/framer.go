@@ -1,6 +1,9 @@
 package worker
 
-import "github.com/herrfz/coordnode/crypto/hmac"
+import (
+	"fmt"
+	"github.com/herrfz/coordnode/crypto/hmac"
+)
 
 const (
 	MAC_CMD       = 1 << (7 - 2) // bit order little endian
@@ -8,18 +11,30 @@ const (
 	ACK_REQUESTED = 1 << (7 - 7)
 )
 
+// addressing modes in the second FCF byte; short addressing (0x98) is the default
+const (
+	FCF_DST_LONG = 0x0c
+	FCF_SRC_LONG = 0xc0
+)
+
 type WDC_REQ struct {
-	MACCMD bool
+	HANDLE byte
+	MACCMD,
+	ACKREQ bool // never set for broadcasts
 	DSTPAN,
 	DSTADDR,
 	MSDU []byte
 	MSDULEN int
 }
 
-func (req *WDC_REQ) ParseWDCReq(buf []byte) {
+func (req *WDC_REQ) ParseWDCReq(buf []byte) error {
 	// parse WDC_MAC_DATA_REQ, cf. EADS MAC Table 29
+	if len(buf) < 9 {
+		return fmt.Errorf("data request too short: %d bytes", len(buf))
+	}
 	TXOPTS := buf[3]
 	ADDRMODE := (TXOPTS & ADDR_MODE) == 0
+	req.HANDLE = buf[2]
 	req.MACCMD = (TXOPTS & MAC_CMD) != 0
 	req.DSTPAN = buf[4:6]
 	if ADDRMODE { // short addr mode
@@ -27,10 +42,19 @@ func (req *WDC_REQ) ParseWDCReq(buf []byte) {
 		req.MSDULEN = int(buf[8])
 		req.MSDU = buf[9:]
 	} else { // long addr mode
+		if len(buf) < 15 {
+			return fmt.Errorf("long address data request too short: %d bytes", len(buf))
+		}
 		req.DSTADDR = buf[6:14] // (64 bits)
 		req.MSDULEN = int(buf[14])
 		req.MSDU = buf[15:]
 	}
+	req.ACKREQ = (TXOPTS&ACK_REQUESTED) != 0 && !req.Broadcast()
+	return nil
+}
+
+func (req *WDC_REQ) Broadcast() bool {
+	return len(req.DSTADDR) == 2 && req.DSTADDR[0] == 0xff && req.DSTADDR[1] == 0xff
 }
 
 type DL_AUTH_FRAME struct {
@@ -45,17 +69,20 @@ type DL_AUTH_FRAME struct {
 	AUTHDATA []byte
 }
 
-func (frame *DL_AUTH_FRAME) MakeDownlinkFrame(req WDC_REQ) {
-	if len(req.MSDU) < 8 { // must be longer than the MAC
-		return
+func (frame *DL_AUTH_FRAME) MakeDownlinkFrame(req WDC_REQ) error {
+	if len(req.MSDU) < 9 || req.MSDULEN != len(req.MSDU) { // must be longer than mID and MAC
+		return fmt.Errorf("authenticated frame too short: %d bytes", len(req.MSDU))
 	}
 
 	frame.FCF = []byte{0x01, 0x98} // FCF
 	frame.SEQNR = []byte{0x00}     // sequence number, must be set to zero
 	frame.DSTPAN = make([]byte, 2)
 	copy(frame.DSTPAN, req.DSTPAN)
-	frame.DSTADDR = make([]byte, 2)
+	frame.DSTADDR = make([]byte, len(req.DSTADDR))
 	copy(frame.DSTADDR, req.DSTADDR)
+	if len(frame.DSTADDR) == 8 { // sent to our EUI-64
+		frame.FCF[1] |= FCF_DST_LONG
+	}
 	frame.MID = []byte{req.MSDU[0]}
 	frame.PAYLOAD = make([]byte, (req.MSDULEN-8)-1)
 	copy(frame.PAYLOAD, req.MSDU[1:req.MSDULEN-8])
@@ -66,6 +93,7 @@ func (frame *DL_AUTH_FRAME) MakeDownlinkFrame(req WDC_REQ) {
 	for i := 0; i < len(authelms); i++ {
 		frame.AUTHDATA = append(frame.AUTHDATA, authelms[i]...)
 	}
+	return nil
 }
 
 type UL_FRAME struct {
@@ -83,6 +111,9 @@ func (frame *UL_FRAME) MakeUplinkFrame(dstpan, dstaddr, srcpan, srcaddr, mid, pa
 	frame.FCF = []byte{0x01, 0x98} // FCF, (see Emeric's email)
 	frame.SEQNR = []byte{0x00}     // sequence number, must be set to zero
 	frame.MFR = []byte{0xde, 0xad} // fake MFR
+	if len(srcaddr) == 8 {
+		frame.FCF[1] |= FCF_SRC_LONG
+	}
 
 	if frame.auth {
 		authelms = [][]byte{frame.FCF, frame.SEQNR, dstpan, dstaddr, srcpan, srcaddr, mid, payload}
@@ -104,14 +135,65 @@ func (frame *UL_FRAME) MakeUplinkFrame(dstpan, dstaddr, srcpan, srcaddr, mid, pa
 }
 
 func MakeMPDU(fcf, dstpan, dstaddr, srcpan, srcaddr, msdu []byte) []byte {
-	// create MAC_DATA_REQUEST frame from WDC_MAC_DATA_REQUEST command
-	MHR := append(fcf,
+	// create MAC_DATA_REQUEST frame from WDC_MAC_DATA_REQUEST command, in a
+	// new slice: appending to the arguments would overwrite what follows them
+	// in the wdc request
+	MHR := append(append([]byte{}, fcf...),
 		0x00) // sequence number, must be set to zero
-	dest_addr := append(dstpan, dstaddr...)
-	src_addr := append(srcpan, srcaddr...)
-	MHR = append(MHR, append(dest_addr, src_addr...)...)
+	for _, field := range [][]byte{dstpan, dstaddr, srcpan, srcaddr} {
+		MHR = append(MHR, field...)
+	}
 
-	return append(MHR, append(msdu, []byte{0xde, 0xad}...)...) // fake MFR
+	return append(append(MHR, msdu...), 0xde, 0xad) // fake MFR
+}
+
+type WDC_IND struct {
+	FCF,
+	DSTPAN,
+	DSTADDR,
+	SRCPAN,
+	SRCADDR,
+	MSDU,
+	MFR,
+	TRAILER []byte
+}
+
+// parse WDC_MAC_DATA_IND as made by MakeWDCInd, e.g. to decode the uplinks of
+// a node; the trailer is what follows the MPDU, at least LQI and ED. PAN ID
+// compression is not supported
+func (ind *WDC_IND) ParseWDCInd(buf []byte) error {
+	if len(buf) < 3 || buf[1] != 0x19 {
+		return fmt.Errorf("not a data indication")
+	}
+	if int(buf[0])+1 != len(buf) || int(buf[2])+3+2 > len(buf) {
+		return fmt.Errorf("data indication length mismatch: %d bytes, length %d, PHR %d", len(buf), buf[0], buf[2])
+	}
+	mpdu := buf[3 : 3+buf[2]]
+	ind.TRAILER = buf[3+buf[2]:]
+
+	mhrLen := 3 + 2 + 2 + 2 + 2
+	if len(mpdu) < mhrLen+2 {
+		return fmt.Errorf("data indication MPDU too short: %d bytes", len(mpdu))
+	}
+	ind.FCF = mpdu[0:2]
+	dstLen, srcLen := 2, 2
+	if ind.FCF[1]&FCF_DST_LONG == FCF_DST_LONG {
+		dstLen = 8
+	}
+	if ind.FCF[1]&FCF_SRC_LONG == FCF_SRC_LONG {
+		srcLen = 8
+	}
+	mhrLen += dstLen - 2 + srcLen - 2
+	if len(mpdu) < mhrLen+2 {
+		return fmt.Errorf("data indication MPDU too short: %d bytes", len(mpdu))
+	}
+	ind.DSTPAN = mpdu[3:5]
+	ind.DSTADDR = mpdu[5 : 5+dstLen]
+	ind.SRCPAN = mpdu[5+dstLen : 7+dstLen]
+	ind.SRCADDR = mpdu[7+dstLen : mhrLen]
+	ind.MSDU = mpdu[mhrLen : len(mpdu)-2]
+	ind.MFR = mpdu[len(mpdu)-2:]
+	return nil
 }
 
 func MakeWDCInd(mpdu, trail []byte) []byte {
@@ -29,3 +29,55 @@ func TestMakeWDCInd(t *testing.T) {
 		t.Errorf("TestMakeWDCInd wrong output: %v, expected: %v", hex.EncodeToString(ind), hex.EncodeToString(out))
 	}
 }
+
+func TestParseWDCReqShort(t *testing.T) {
+	for _, buf := range [][]byte{{}, {0x01, 0x17}, {0x08, 0x17, 0x01, 0x00, 0xb1, 0xca, 0x01, 0x00},
+		{0x0e, 0x17, 0x01, 0x10, 0xb1, 0xca, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}} {
+		req := WDC_REQ{}
+		if err := req.ParseWDCReq(buf); err == nil {
+			t.Errorf("no error parsing %v", hex.EncodeToString(buf))
+		}
+	}
+
+	frame := DL_AUTH_FRAME{}
+	if err := frame.MakeDownlinkFrame(WDC_REQ{MSDULEN: 2, MSDU: []byte{0x0b, 0x00}}); err == nil {
+		t.Errorf("no error making downlink frame without MAC")
+	}
+}
+
+// link status report, cf. the bytemapping file
+var linkStatusInd, _ = hex.DecodeString("31192a01887effffffff1caa000001cb1a140d00088a01000089010000" +
+	"f03f01088a010000000000000000f689ff3f960000")
+
+func TestParseWDCInd(t *testing.T) {
+	ind := WDC_IND{}
+	if err := ind.ParseWDCInd(linkStatusInd); err != nil {
+		t.Fatalf("error parsing: %v", err.Error())
+	}
+	if !bytes.Equal(ind.SRCPAN, []byte{0x1c, 0xaa}) || !bytes.Equal(ind.SRCADDR, []byte{0x00, 0x00}) {
+		t.Errorf("wrong output: %x %x, expected: 1caa 0000", ind.SRCPAN, ind.SRCADDR)
+	}
+	if !bytes.Equal(ind.MSDU, linkStatusInd[14:43]) {
+		t.Errorf("wrong output: %x, expected: %x", ind.MSDU, linkStatusInd[14:43])
+	}
+	if !bytes.Equal(ind.TRAILER, []byte{0xff, 0x3f, 0x96, 0x00, 0x00}) {
+		t.Errorf("wrong output: %x, expected: ff3f960000", ind.TRAILER)
+	}
+
+	// a made indication parses back
+	ulFrame := UL_FRAME{}
+	ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, []byte{0xb1, 0xca}, MakeEUI64([]byte{0x00, 0x12, 0x4b}, 1), []byte{0x09}, []byte{0x42}, nil)
+	if err := ind.ParseWDCInd(MakeWDCInd(ulFrame.FRAME, StaticLink{}.Trailer())); err != nil || !bytes.Equal(ind.MSDU, []byte{0x42}) || len(ind.SRCADDR) != 8 {
+		t.Errorf("wrong output: %+v, %v", ind, err)
+	}
+
+	// the longer trailer of the serial passthrough
+	trail := []byte{0xff, 0x3f, 0x00, 0x00, 0x00, 0x00}
+	if err := ind.ParseWDCInd(MakeWDCInd(ulFrame.FRAME, trail)); err != nil || !bytes.Equal(ind.TRAILER, trail) {
+		t.Errorf("wrong output: %x, %v, expected: %x", ind.TRAILER, err, trail)
+	}
+
+	if err := ind.ParseWDCInd(linkStatusInd[:40]); err == nil {
+		t.Errorf("no error parsing truncated indication")
+	}
+}
@@ -0,0 +1,368 @@
+package worker
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"github.com/herrfz/coordnode/clock"
+	"sync/atomic"
+	"time"
+)
+
+// node serial message types
+const (
+	MSG_HELLO     = 1
+	MSG_HELLO_ACK = 2
+	MSG_APP       = 3
+	MSG_DEBUG     = 4
+	MSG_ACK       = 5 // extended framing only
+	MSG_NAK       = 6 // extended framing only
+)
+
+// capabilities offered in the hello and accepted in the hello ack; firmware
+// answering with an empty hello ack speaks the legacy framing
+const (
+	CAP_SEQ      = 1 << 0 // sequence number after the length, ACK/NAK and retransmission
+	CAP_CRC16    = 1 << 1 // CRC-16 trailer instead of the one byte checksum
+	CAP_LONG_LEN = 1 << 2 // two byte length, little endian, for messages beyond 255 bytes
+)
+
+// longest message accepted with two byte length
+const MAX_MSG_LEN = 1024
+
+// Framing encodes and decodes node serial messages with the negotiated
+// capabilities; the zero value is the legacy framing of Message
+type Framing struct {
+	Caps byte
+}
+
+func (f Framing) lenSize() int {
+	if f.Caps&CAP_LONG_LEN != 0 {
+		return 2
+	}
+	return 1
+}
+
+// bytes before the data: mtype, length, sequence number
+func (f Framing) headerSize() int {
+	if f.Caps&CAP_SEQ != 0 {
+		return 2 + f.lenSize()
+	}
+	return 1 + f.lenSize()
+}
+
+func (f Framing) trailerSize() int {
+	if f.Caps&CAP_CRC16 != 0 {
+		return 2
+	}
+	return 1
+}
+
+func (f Framing) maxLen() int {
+	if f.Caps&CAP_LONG_LEN != 0 {
+		return MAX_MSG_LEN
+	}
+	return 0xff
+}
+
+// total message length as given in the length field
+func (f Framing) decodeLen(lenField []byte) int {
+	if f.Caps&CAP_LONG_LEN != 0 {
+		return int(binary.LittleEndian.Uint16(lenField))
+	}
+	return int(lenField[0])
+}
+
+// whether msg can be encoded, longer ones would wrap the length field
+func (f Framing) fits(msg Message) bool {
+	return f.headerSize()+len(msg.data)+f.trailerSize() <= f.maxLen()
+}
+
+// callers check fits first
+func (f Framing) Encode(msg Message, seq byte) []byte {
+	hlen := f.headerSize()
+	buflen := hlen + len(msg.data) + f.trailerSize()
+
+	buf := make([]byte, buflen)
+	buf[0] = byte(msg.mtype)
+	if f.Caps&CAP_LONG_LEN != 0 {
+		binary.LittleEndian.PutUint16(buf[1:3], uint16(buflen))
+	} else {
+		buf[1] = byte(buflen)
+	}
+	if f.Caps&CAP_SEQ != 0 {
+		buf[hlen-1] = seq
+	}
+	copy(buf[hlen:], msg.data)
+
+	if f.Caps&CAP_CRC16 != 0 {
+		binary.LittleEndian.PutUint16(buf[buflen-2:], calcCRC16(buf[:buflen-2]))
+	} else {
+		buf[buflen-1] = calcChecksum(buf[:buflen-1])
+	}
+
+	return buf
+}
+
+func (f Framing) Decode(buf []byte) (Message, byte, error) {
+	msg := Message{}
+	if f.Caps == 0 {
+		err := msg.ParseBuffer(buf)
+		return msg, 0, err
+	}
+
+	buflen := len(buf)
+	hlen := f.headerSize()
+	if buflen < hlen+f.trailerSize() {
+		return msg, 0, fmt.Errorf("message too short: %d bytes", buflen)
+	}
+
+	var seq byte
+	if f.Caps&CAP_SEQ != 0 {
+		seq = buf[hlen-1]
+	}
+	if f.decodeLen(buf[1:]) != buflen {
+		return msg, seq, fmt.Errorf("invalid length")
+	}
+
+	if f.Caps&CAP_CRC16 != 0 {
+		if binary.LittleEndian.Uint16(buf[buflen-2:]) != calcCRC16(buf[:buflen-2]) {
+			return msg, seq, fmt.Errorf("invalid CRC")
+		}
+	} else if buf[buflen-1] != calcChecksum(buf[:buflen-1]) {
+		return msg, seq, fmt.Errorf("invalid checksum")
+	}
+
+	msg.mtype = int(buf[0])
+	msg.data = buf[hlen : buflen-f.trailerSize()]
+	return msg, seq, nil
+}
+
+// CRC-16/CCITT as in the 802.15.4 FCS: polynomial 0x1021 reflected, zero init
+func calcCRC16(data []byte) uint16 {
+	var crc uint16
+	for _, b := range data {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return crc
+}
+
+// negotiated framing, shared between the reader goroutine and the worker
+type linkFraming struct {
+	caps  uint32
+	offer byte // capabilities sent in the hello, 0 if this side answers hellos
+}
+
+func (l *linkFraming) get() Framing {
+	if l == nil {
+		return Framing{}
+	}
+	return Framing{byte(atomic.LoadUint32(&l.caps))}
+}
+
+func (l *linkFraming) set(f Framing) {
+	atomic.StoreUint32(&l.caps, uint32(f.Caps))
+}
+
+// take the capabilities of a hello ack as soon as it is read, the node may
+// send in the new framing right after it
+func (l *linkFraming) accept(buf []byte) {
+	ack := Message{}
+	if l == nil || l.offer == 0 || ack.ParseBuffer(buf) != nil || ack.mtype != MSG_HELLO_ACK {
+		return
+	}
+	framing := Framing{}
+	if len(ack.data) > 0 {
+		framing.Caps = ack.data[0] & l.offer
+	}
+	l.set(framing)
+}
+
+// retransmission of unacknowledged messages, one message in flight
+const (
+	ARQ_TIMEOUT     = 200 * time.Millisecond // doubled on every retry
+	ARQ_MAX_RETRIES = 5
+)
+
+// arqSender queues outgoing messages and tells the caller which frame to write
+// next; it does no I/O itself. confirm, if set, is called with the handle of a
+// confirmed message once it is acknowledged, or written without sequencing, and
+// with MAC_NO_ACK once it is dropped
+type arqSender struct {
+	framing Framing
+	queue   []arqMessage
+	seq     byte
+	retries int
+	timer   *clock.Timer
+	confirm func(handle, status byte)
+}
+
+type arqMessage struct {
+	msg       Message
+	handle    byte
+	confirmed bool // handle is confirmed
+}
+
+// frame to write now, nil if the message waits for an earlier one
+func (s *arqSender) send(msg Message) []byte {
+	return s.enqueue(arqMessage{msg: msg})
+}
+
+// the same, for a message confirmed with handle
+func (s *arqSender) sendConfirmed(msg Message, handle byte) []byte {
+	return s.enqueue(arqMessage{msg, handle, true})
+}
+
+func (s *arqSender) enqueue(m arqMessage) []byte {
+	if s.framing.Caps&CAP_SEQ == 0 {
+		s.done(m, MAC_SUCCESS)
+		return s.framing.Encode(m.msg, 0) // fire and forget
+	}
+
+	s.queue = append(s.queue, m)
+	if len(s.queue) > 1 {
+		return nil
+	}
+	return s.transmit()
+}
+
+// drop all queued messages, e.g. with the link
+func (s *arqSender) drop() {
+	for _, m := range s.queue {
+		s.done(m, MAC_NO_ACK)
+	}
+	s.queue = nil
+	s.retries = 0
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+func (s *arqSender) done(m arqMessage, status byte) {
+	if m.confirmed && s.confirm != nil {
+		s.confirm(m.handle, status)
+	}
+}
+
+// frame to write after an ACK, nil if nothing is queued or the ACK is stale
+func (s *arqSender) ack(seq byte) []byte {
+	if len(s.queue) == 0 || seq != s.seq {
+		return nil
+	}
+	s.done(s.queue[0], MAC_SUCCESS)
+	s.next()
+	if len(s.queue) == 0 {
+		return nil
+	}
+	return s.transmit()
+}
+
+// frame to write after a NAK, the message in flight is repeated at once
+func (s *arqSender) nak(seq byte) []byte {
+	if len(s.queue) == 0 || seq != s.seq {
+		return nil
+	}
+	return s.retransmit()
+}
+
+// frame to write when the ACK timer expires; the message is dropped after
+// ARQ_MAX_RETRIES and the next one is sent
+func (s *arqSender) expire() []byte {
+	if len(s.queue) == 0 {
+		return nil
+	}
+	return s.retransmit()
+}
+
+// channel of the running ACK timer, nil when nothing is in flight
+func (s *arqSender) timeout() <-chan time.Time {
+	if s.timer == nil || len(s.queue) == 0 {
+		return nil
+	}
+	return s.timer.C
+}
+
+// frames to write after a new hello exchange: the message in flight is sent
+// again in the new framing, or the whole queue if the node went back to legacy
+func (s *arqSender) restart(framing Framing) []byte {
+	s.framing = framing
+	s.retries = 0
+	if len(s.queue) == 0 {
+		return nil
+	}
+
+	if framing.Caps&CAP_SEQ == 0 {
+		var buf []byte
+		for _, m := range s.queue {
+			buf = append(buf, framing.Encode(m.msg, 0)...)
+			s.done(m, MAC_SUCCESS)
+		}
+		s.queue = nil
+		return buf
+	}
+	return s.transmit()
+}
+
+func (s *arqSender) transmit() []byte {
+	s.startTimer(ARQ_TIMEOUT)
+	return s.framing.Encode(s.queue[0].msg, s.seq)
+}
+
+func (s *arqSender) retransmit() []byte {
+	s.retries++
+	if s.retries > ARQ_MAX_RETRIES {
+		fmt.Println("dropped unacknowledged serial message:", s.seq, hex.EncodeToString(s.queue[0].msg.data))
+		s.done(s.queue[0], MAC_NO_ACK)
+		s.next()
+		if len(s.queue) == 0 {
+			return nil
+		}
+		return s.transmit()
+	}
+	s.startTimer(ARQ_TIMEOUT << uint(s.retries))
+	return s.framing.Encode(s.queue[0].msg, s.seq)
+}
+
+func (s *arqSender) next() {
+	s.queue = s.queue[1:]
+	s.seq++
+	s.retries = 0
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+func (s *arqSender) startTimer(d time.Duration) {
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.timer = clock.NewTimer(d)
+}
+
+// arqReceiver acknowledges sequenced messages and suppresses duplicates
+type arqReceiver struct {
+	framing Framing
+	last    int // sequence number of the last delivered message, -1 before the first
+}
+
+// ACK frame to write, and whether the message is new and shall be delivered
+func (r *arqReceiver) receive(seq byte) ([]byte, bool) {
+	ack := r.framing.Encode(Message{MSG_ACK, []byte{}}, seq)
+	if r.last == int(seq) {
+		return ack, false
+	}
+	r.last = int(seq)
+	return ack, true
+}
+
+// NAK frame to write for a corrupted message
+func (r *arqReceiver) reject(seq byte) []byte {
+	return r.framing.Encode(Message{MSG_NAK, []byte{}}, seq)
+}
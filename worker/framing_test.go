@@ -0,0 +1,201 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"testing"
+)
+
+var seqFraming = Framing{CAP_SEQ}
+
+func TestFramingLegacy(t *testing.T) {
+	for _, test := range tests {
+		if buf := (Framing{}).Encode(test.msg, 7); !bytes.Equal(buf, test.buf) {
+			t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(buf), hex.EncodeToString(test.buf))
+		}
+	}
+}
+
+func TestFramingSeq(t *testing.T) {
+	msg := Message{MSG_APP, []byte{0xca, 0xfe}}
+	out := []byte{0x03, 0x06, 0x07, 0xca, 0xfe, 0x27}
+
+	buf := seqFraming.Encode(msg, 7)
+	if !bytes.Equal(buf, out) {
+		t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(buf), hex.EncodeToString(out))
+	}
+
+	rcvd, seq, err := seqFraming.Decode(buf)
+	if err != nil {
+		t.Fatalf("error parsing: %v", err.Error())
+	}
+	if rcvd.mtype != msg.mtype || seq != 7 || !bytes.Equal(rcvd.data, msg.data) {
+		t.Errorf("wrong message: %v %v %v", rcvd.mtype, seq, hex.EncodeToString(rcvd.data))
+	}
+
+	buf[3] ^= 0xff
+	if _, seq, err := seqFraming.Decode(buf); err == nil || seq != 7 {
+		t.Errorf("no error decoding corrupted message, seq: %v", seq)
+	}
+}
+
+func TestArqSender(t *testing.T) {
+	s := arqSender{framing: seqFraming}
+	first := Message{MSG_APP, []byte{0x01}}
+	second := Message{MSG_APP, []byte{0x02}}
+
+	if buf := s.send(first); !bytes.Equal(buf, seqFraming.Encode(first, 0)) {
+		t.Errorf("first message not sent: %v", hex.EncodeToString(buf))
+	}
+	if buf := s.send(second); buf != nil {
+		t.Errorf("second message sent before first is acknowledged: %v", hex.EncodeToString(buf))
+	}
+	if s.timeout() == nil {
+		t.Errorf("no timer running")
+	}
+
+	if buf := s.ack(1); buf != nil {
+		t.Errorf("stale ack accepted")
+	}
+	if buf := s.nak(0); !bytes.Equal(buf, seqFraming.Encode(first, 0)) {
+		t.Errorf("first message not repeated on nak: %v", hex.EncodeToString(buf))
+	}
+	if buf := s.ack(0); !bytes.Equal(buf, seqFraming.Encode(second, 1)) {
+		t.Errorf("second message not sent on ack: %v", hex.EncodeToString(buf))
+	}
+
+	for i := 0; i < ARQ_MAX_RETRIES; i++ {
+		if buf := s.expire(); !bytes.Equal(buf, seqFraming.Encode(second, 1)) {
+			t.Errorf("retry %d not sent: %v", i, hex.EncodeToString(buf))
+		}
+	}
+	if buf := s.expire(); buf != nil || len(s.queue) != 0 {
+		t.Errorf("message not dropped after %d retries", ARQ_MAX_RETRIES)
+	}
+	if s.timeout() != nil {
+		t.Errorf("timer running with nothing in flight")
+	}
+}
+
+func TestArqSenderConfirm(t *testing.T) {
+	var confirmed []byte
+	s := arqSender{framing: seqFraming, confirm: func(handle, status byte) {
+		confirmed = append(confirmed, handle, status)
+	}}
+	msg := Message{MSG_APP, []byte{0x01}}
+
+	s.sendConfirmed(msg, 0x11)
+	s.sendConfirmed(msg, 0x22)
+	s.send(msg)
+	if len(confirmed) != 0 {
+		t.Errorf("confirmed before ack: %v", hex.EncodeToString(confirmed))
+	}
+	s.ack(0)
+	for i := 0; i <= ARQ_MAX_RETRIES; i++ {
+		s.expire()
+	}
+	s.drop()
+	expected := []byte{0x11, MAC_SUCCESS, 0x22, MAC_NO_ACK}
+	if !bytes.Equal(confirmed, expected) {
+		t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(confirmed), hex.EncodeToString(expected))
+	}
+
+	confirmed = nil
+	s.sendConfirmed(msg, 0x33)
+	s.drop()
+	if expected := []byte{0x33, MAC_NO_ACK}; !bytes.Equal(confirmed, expected) {
+		t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(confirmed), hex.EncodeToString(expected))
+	}
+	if len(s.queue) != 0 {
+		t.Errorf("queue not dropped")
+	}
+}
+
+func TestArqReceiver(t *testing.T) {
+	r := arqReceiver{framing: seqFraming, last: -1}
+	ack := seqFraming.Encode(Message{MSG_ACK, []byte{}}, 0)
+
+	if buf, isNew := r.receive(0); !isNew || !bytes.Equal(buf, ack) {
+		t.Errorf("first message not delivered: %v %v", isNew, hex.EncodeToString(buf))
+	}
+	if buf, isNew := r.receive(0); isNew || !bytes.Equal(buf, ack) {
+		t.Errorf("duplicate delivered: %v %v", isNew, hex.EncodeToString(buf))
+	}
+	if _, isNew := r.receive(1); !isNew {
+		t.Errorf("next message not delivered")
+	}
+}
+
+func TestCRC16(t *testing.T) {
+	if crc := calcCRC16([]byte("123456789")); crc != 0x2189 {
+		t.Errorf("wrong CRC: %04x, expected: 2189", crc)
+	}
+}
+
+func TestFramingCRCLongLen(t *testing.T) {
+	framing := Framing{CAP_SEQ | CAP_CRC16 | CAP_LONG_LEN}
+	msg := Message{MSG_APP, bytes.Repeat([]byte{0xaa}, 300)}
+
+	buf := framing.Encode(msg, 3)
+	if len(buf) != 306 || buf[1] != 0x32 || buf[2] != 0x01 || buf[3] != 3 {
+		t.Errorf("wrong header: %v, length: %v", hex.EncodeToString(buf[:4]), len(buf))
+	}
+
+	rcvd, seq, err := framing.Decode(buf)
+	if err != nil || seq != 3 || !bytes.Equal(rcvd.data, msg.data) {
+		t.Errorf("wrong message: %v %v %v", seq, len(rcvd.data), err)
+	}
+
+	buf[100] ^= 0x01
+	if _, _, err := framing.Decode(buf); err == nil {
+		t.Errorf("no error decoding corrupted message")
+	}
+}
+
+func TestFramingFits(t *testing.T) {
+	short := Message{MSG_APP, bytes.Repeat([]byte{0xaa}, 0xff-4)}
+	long := Message{MSG_APP, bytes.Repeat([]byte{0xaa}, 0xff-3)}
+
+	if !seqFraming.fits(short) || seqFraming.fits(long) {
+		t.Errorf("wrong output: %v %v, expected: true false", seqFraming.fits(short), seqFraming.fits(long))
+	}
+	if !(Framing{}).fits(Message{MSG_APP, long.data[1:]}) {
+		t.Errorf("legacy message not accepted")
+	}
+	if framing := (Framing{CAP_LONG_LEN}); !framing.fits(long) {
+		t.Errorf("long message not accepted")
+	}
+}
+
+type testPort struct {
+	io.Reader
+}
+
+func (p testPort) Write(buf []byte) (int, error) { return len(buf), nil }
+func (p testPort) Close() error                  { return nil }
+
+func TestSerialReader(t *testing.T) {
+	long := &linkFraming{}
+	long.set(Framing{CAP_LONG_LEN})
+	msg := (Framing{CAP_LONG_LEN}).Encode(Message{MSG_APP, bytes.Repeat([]byte{0xaa}, 200)}, 0)
+
+	buf, err := SerialReader{testPort{bytes.NewReader(msg)}, long}.ReadDevice()
+	if err != nil || !bytes.Equal(buf, msg) {
+		t.Errorf("wrong message: %v, %v", hex.EncodeToString(buf), err)
+	}
+
+	failures := []struct {
+		framing *linkFraming
+		buf     []byte
+	}{
+		{nil, []byte{0x03, 0x05, 0xca}},              // truncated
+		{nil, []byte{0x03, 0x01, 0xca}},              // shorter than header and checksum
+		{long, []byte{0x03, 0x00, 0x10, 0xca, 0xfe}}, // oversized
+	}
+	for _, test := range failures {
+		if _, err := (SerialReader{testPort{bytes.NewReader(test.buf)}, test.framing}).ReadDevice(); err == nil {
+			t.Errorf("no error reading %v", hex.EncodeToString(test.buf))
+		}
+	}
+}
@@ -6,25 +6,30 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"github.com/herrfz/coordnode/clock"
 	"github.com/herrfz/coordnode/crypto/blockcipher"
 	"github.com/herrfz/coordnode/crypto/ecdh"
 	"github.com/herrfz/coordnode/crypto/hmac"
+	"github.com/herrfz/coordnode/energy"
+	"github.com/herrfz/coordnode/rng"
 	"sync"
 	"time"
 )
 
-func DoDataRequest(nodeAddr []byte, dlCh, ulCh, appDlCh, appUlCh, crossCh chan []byte, secure bool) {
-	var NIK, S, AK, SIK, SCK []byte
-	var UL_POLICY byte
-	var COUNTER_BYTE = make([]byte, 4)
-	var COUNTER uint32 = 0
+// DoDataRequest runs until dlCh is closed or processing a request fails; on
+// return appDlCh and ulCh are closed, after the app and all pending requests
+// have finished
+func DoDataRequest(node NodeConfig, dlCh, ulCh, appDlCh, appUlCh, crossCh chan []byte) error {
+	var session = node.Session
+	if session == nil {
+		session = NewSession(node.Keys)
+	}
+	session.setPolicies(0x00, node.ULPolicy)
 	var nfcData = make([]byte, 6)
 	copy(nfcData, []byte{0x30, 0x30, 0x30, 0x41}) // 000Axx; shall be updated through crossCh channel
-	// trailing LQI, ED, RX status, RX slot; TODO, all zeros for now
-	var trail = []byte{0x00, 0x00, 0x96, 0x00, 0x00}
 
-	// protect access to uplink channel (apps and keymgmt goroutines)
-	var mutex = &sync.Mutex{}
+	var ivs = node.keyReader() // of the uplinks
+	var nodeAddr, secure = node.Addr, node.Secure
 
 	addr := binary.LittleEndian.Uint16(nodeAddr)
 	addr = 12336 + addr // ascii offset: 12336, 0x3030
@@ -32,287 +37,584 @@ func DoDataRequest(nodeAddr []byte, dlCh, ulCh, appDlCh, appUlCh, crossCh chan [
 	binary.BigEndian.PutUint16(bigEAddr, uint16(addr))
 	copy(nfcData[4:], bigEAddr)
 
-LOOP:
-	for {
-		select {
-		case appData := <-crossCh: // allow application to send misc data
-			copy(nfcData, appData) // do nothing, just store
+	if node.Link == nil {
+		node.Link = StaticLink{}
+	}
 
-		case payload := <-appUlCh:
-			// uplink
-			ulFrame := UL_FRAME{auth: secure}
-			if secure {
-				COUNTER++
-				binary.BigEndian.PutUint32(COUNTER_BYTE, COUNTER)
+	// protect access to uplink channel (apps and keymgmt goroutines)
+	var mutex = &sync.Mutex{}
 
-				var procMSDU []byte
-				if UL_POLICY == 0x01 {
-					procMSDU, _ = blockcipher.AESEncryptCBCPKCS7(SCK, payload)
-				} else {
-					procMSDU = payload
+	// request goroutines, and the first of their failures
+	var wg sync.WaitGroup
+	var errCh = make(chan error, 1)
+
+	// the app stops on its own only if it fails; downlinks are dropped from then on
+	var appUl = appUlCh
+	var appStopped = make(chan bool)
+	stopApp := func() {
+		appUl = nil
+		close(appStopped)
+	}
+
+	defer func() {
+		// pending requests may still hand downlinks to the app, and the app
+		// may still be sending until appDlCh is closed
+		requestsDone := make(chan bool)
+		go func() {
+			wg.Wait()
+			close(requestsDone)
+		}()
+		for requestsDone != nil || appUl != nil {
+			select {
+			case <-crossCh:
+			case <-requestsDone:
+				close(appDlCh)
+				requestsDone = nil
+			case _, more := <-appUl:
+				if !more {
+					stopApp()
 				}
+			}
+		}
+		close(ulCh)
+		fmt.Println("node processor stopped")
+	}()
+
+	sendUl := func(buf []byte) {
+		mutex.Lock()
+		ulCh <- buf
+		mutex.Unlock()
+	}
 
-				ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
-					[]byte{0xb1, 0xca}, // sensor pan
-					nodeAddr,           // sensor addr
-					[]byte{0x09},       // mID unicast
-					append(COUNTER_BYTE, procMSDU...), SIK)
+	// energy drawn from the battery; once it is depleted the node is dead and
+	// neither sends nor receives anything
+	var dying sync.Once
+	charge := func(op energy.Op, n int) bool {
+		if node.Energy == nil || node.Energy.Charge(op, n) {
+			return true
+		}
+		dying.Do(func() { fmt.Println("battery depleted, node is dead") })
+		return false
+	}
+	verifyMAC := func(key, data, mac []byte) ([]byte, bool) {
+		charge(energy.HMAC, len(data))
+		return hmac.SHA256HMACVerify(key, data, mac)
+	}
+	decrypt := func(key, data []byte) ([]byte, error) {
+		charge(energy.AES, len(data))
+		return blockcipher.AESDecryptCBCPKCS7(key, data)
+	}
+	sign := func(frame UL_FRAME) {
+		if frame.auth {
+			charge(energy.HMAC, len(frame.FRAME))
+		}
+	}
 
+	// send an uplink frame, retransmitted until the coordinator acknowledges it
+	// if uplinks are acknowledged; a lost acknowledgement duplicates the frame
+	sendInd := func(r *rng.Rand, IND []byte) {
+		for attempt := 0; ; attempt++ {
+			received := false
+			if !charge(energy.TX, len(IND)-3-5) { // MPDU
+				return
+			}
+			collided := node.collided(r, IND) // on the air even if lost
+			if node.Link.Lost(r) {
+				session.countUplink(false, 0)
+				fmt.Println("lost WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
+			} else if collided {
+				session.countUplink(false, 0)
+				fmt.Println("collided WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
+			} else if node.Link.Corrupted(r) {
+				session.countUplink(false, 0) // fails the CRC at the coordinator
+				corrupted := append([]byte{}, IND...)
+				corruptInd(r, corrupted)
+				sendUl(corrupted)
+				fmt.Println("corrupted WDC_MAC_DATA_IND")
 			} else {
-				ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
-					[]byte{0xb1, 0xca}, // sensor pan
-					nodeAddr,           // sensor addr
-					[]byte{0x09},       // mID unicast
-					payload, SIK)       // SIK is not actually used here
+				session.countUplink(true, IND[len(IND)-4]) // ED of the trailer
+				sendUl(IND)
+				fmt.Println("sent WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
+				received = true
 			}
 
-			IND := MakeWDCInd(ulFrame.FRAME, trail)
-
-			mutex.Lock()
-			ulCh <- IND
-			mutex.Unlock()
-			fmt.Println("sent WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
+			if !node.Ack.Uplink {
+				return
+			}
+			if received && !node.Ack.lost(r) && charge(energy.RX, len(MakeAckFrame(0x00))) {
+				return
+			}
+			if attempt == node.Ack.Retries {
+				fmt.Println("uplink not acknowledged after", attempt, "retransmissions")
+				return
+			}
+			clock.Sleep(node.Ack.wait(r, attempt))
+		}
+	}
 
-		case buf, more := <-dlCh:
-			if !more {
-				close(appDlCh)
-				<-appUlCh
-				close(ulCh)
-				break LOOP // stop goroutine no more data
+	// transmit a downlink that requests an acknowledgement and confirm it to the
+	// wdc; false if the node never received it
+	ackDownlink := func(r *rng.Rand, req WDC_REQ) bool {
+		delivered := false
+		for attempt := 0; ; attempt++ {
+			if !node.Link.Lost(r) && charge(energy.RX, len(req.MSDU)+13) && charge(energy.TX, len(MakeAckFrame(0x00))) {
+				delivered = true
+				fmt.Println("sent acknowledgement frame:", hex.EncodeToString(MakeAckFrame(0x00)))
+				if !node.Ack.lost(r) {
+					sendUl(MakeDataCon(req.HANDLE, MAC_SUCCESS))
+					return true
+				}
 			}
+			if attempt == node.Ack.Retries {
+				fmt.Println("downlink not acknowledged after", attempt, "retransmissions")
+				sendUl(MakeDataCon(req.HANDLE, MAC_NO_ACK))
+				return delivered
+			}
+			clock.Sleep(node.Ack.wait(r, attempt))
+		}
+	}
 
-			wdcReq := WDC_REQ{}
-			wdcReq.ParseWDCReq(buf)
+	// downlinks of a sleepy node, waiting for it to poll; they expire in order
+	sleepy := node.Sleep.Poll > 0
+	persistence := node.Sleep.Persistence
+	if persistence <= 0 {
+		persistence = DEFAULT_PERSISTENCE
+	}
+	var queue []transaction
+	var poll, expire <-chan time.Time
+	if sleepy {
+		poll = clock.After(node.Sleep.Poll)
+	}
+	nextExpiry := func() <-chan time.Time {
+		if len(queue) == 0 {
+			return nil
+		}
+		return clock.After(clock.Until(queue[0].expires))
+	}
+	defer func() { // before ulCh is closed
+		for _, t := range queue {
+			sendUl(MakeDataCon(t.req.HANDLE, MAC_TRANSACTION_EXPIRED))
+		}
+	}()
+
+	// process a valid data request in its own goroutine; it draws from streams
+	// of its own, derived in the order of the requests. received is set if the
+	// node already received a request without acknowledgement on a poll
+	process := func(buf []byte, wdcReq WDC_REQ, received bool) {
+		r, keyRand := node.Rand.New(), node.keyReader()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() {
+				if r := recover(); r != nil {
+					select {
+					case errCh <- fmt.Errorf("processing %s: %v", hex.EncodeToString(buf), r):
+					default:
+					}
+				}
+			}()
 
-			if len(wdcReq.MSDU) == 0 {
-				fmt.Println("zero length MSDU")
-				continue
+			if wdcReq.ACKREQ && !ackDownlink(r, wdcReq) {
+				return
 			}
-
-			if wdcReq.MSDULEN != len(wdcReq.MSDU) {
-				fmt.Println("MSDU length mismatch, on frame:", wdcReq.MSDULEN, ", received:", len(wdcReq.MSDU))
-				continue
+			if !wdcReq.ACKREQ && !received && !charge(energy.RX, len(wdcReq.MSDU)+13) { // MHR and MFR
+				return
 			}
 
-			go func() {
-				if wdcReq.MACCMD {
-					cmdID := wdcReq.MSDU[0]
-					switch cmdID {
-					case 0x00: // beacon
-					case 0x01: // set param
-					case 0x02: // get param
-					case 0x04: // disassociation req
-						reassocAllowed := (wdcReq.MSDU[1] == 0xfe) // 0xFE for allowed association TBC
-						if reassocAllowed {
-							fmt.Println("received disassociation request, reassociate allowed")
-							time.Sleep(1000 * time.Millisecond)
-							assocReq := append(append([]byte{0x05, 0x01}, // assocReq cmd id, seqnbr
-								nfcData...),
-								0x14) // sensorType temperature
-
-							MPDU := MakeMPDU([]byte{0x04, 0xd8}, // FCF MAC command, long src address
-								[]byte{0xff, 0xff}, []byte{0xff, 0xff},
-								[]byte{0xb1, 0xca}, append(nodeAddr, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}...),
-								assocReq)
-
-							IND := MakeWDCInd(MPDU, trail)
-
-							mutex.Lock()
-							ulCh <- IND
-							mutex.Unlock()
-							fmt.Println("sent WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
-
-						} else {
-							fmt.Println("received disassociation request, reassociate not allowed")
-						}
-					case 0x06: // assoc resp
-						fmt.Println("received association response")
-					case 0x07: // reset req
-					default:
-						fmt.Println("received wrong MAC command ID")
+			keys := session.Keys()
+			if wdcReq.MACCMD {
+				cmdID := wdcReq.MSDU[0]
+				switch cmdID {
+				case 0x00: // beacon
+				case 0x01: // set param
+				case 0x02: // get param
+				case 0x04: // disassociation req
+					if len(wdcReq.MSDU) < 2 {
+						fmt.Println("received disassociation request without reason")
 						return
 					}
-				} else {
-					mID := wdcReq.MSDU[0]
-					switch mID {
-					// application data
-					case 0x09, 0x0A:
-						// authenticate, check replay, decrypt
-						// then:
-						fmt.Println("received application data:", hex.EncodeToString(wdcReq.MSDU))
-
-					// generate NIK / unauth ecdh
-					case 0x01:
-						dap := wdcReq.MSDU[1:]
-						if !ecdh.CheckPublic(dap) {
-							// drop
-							fmt.Println("received invalid public key:", hex.EncodeToString(dap))
-							return
-						}
-						db, _ := ecdh.GeneratePrivate()
-						dbp := ecdh.GeneratePublic(db)
-						zz, _ := ecdh.GenerateSecret(db, dap)
-						fmt.Println("shared secret:", hex.EncodeToString(zz))
-
-						zz_h := sha256.Sum256(zz)
-						NIK = zz_h[:16] // NIK := first 128 bits / 16 Bytes of the hash of the secret
-						fmt.Println("For sensor address:", hex.EncodeToString(wdcReq.DSTADDR),
-							"generated NIK:", hex.EncodeToString(NIK))
-
-						// the MPDU of the return message
-						MPDU := MakeMPDU([]byte{0x01, 0x98}, // FCF MAC data
+					reassocAllowed := (wdcReq.MSDU[1] == 0xfe) // 0xFE for allowed association TBC
+					if reassocAllowed {
+						fmt.Println("received disassociation request, reassociate allowed")
+						clock.Sleep(1000 * time.Millisecond)
+						assocReq := append(append([]byte{0x05, 0x01}, // assocReq cmd id, seqnbr
+							nfcData...),
+							0x14) // sensorType temperature
+
+						MPDU := MakeMPDU([]byte{0x04, 0xd8}, // FCF MAC command, long src address
 							[]byte{0xff, 0xff}, []byte{0xff, 0xff},
-							wdcReq.DSTPAN, wdcReq.DSTADDR,
-							append([]byte{0x02}, // mID NIK response
-								dbp...))
-
-						IND := MakeWDCInd(MPDU, trail)
-
-						time.Sleep(500 * time.Millisecond) // delay to give the server time to react
-
-						mutex.Lock()
-						ulCh <- IND
-						mutex.Unlock()
-						fmt.Println("sent WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
-
-					// generate LTSS or generate session keys / auth ecdh
-					case 0x03, 0x05:
-						authkey := make([]byte, 16)
-						if mID == 0x03 {
-							copy(authkey, NIK)
-						} else {
-							copy(authkey, AK)
-						}
-						// ltss, sessionkey / auth ecdh
+							node.PAN, FrameAddr(node.EUI),
+							assocReq)
+
+						IND := MakeWDCInd(MPDU, node.Link.Trailer())
+
+						sendInd(r, IND)
+
+					} else {
+						fmt.Println("received disassociation request, reassociate not allowed")
+					}
+				case 0x06: // assoc resp
+					fmt.Println("received association response")
+				case 0x07: // reset req
+				default:
+					fmt.Println("received wrong MAC command ID")
+					return
+				}
+			} else {
+				mID := wdcReq.MSDU[0]
+				switch mID {
+				// application data
+				case 0x09, 0x0A:
+					payload := wdcReq.MSDU[1:]
+					if secure {
+						// authenticate, strip counter, decrypt; TODO: check replay
 						dlFrame := DL_AUTH_FRAME{}
-						dlFrame.MakeDownlinkFrame(wdcReq)
+						if err := dlFrame.MakeDownlinkFrame(wdcReq); err != nil {
+							fmt.Println("invalid downlink frame:", err.Error())
+							return
+						}
 
-						if expectedMAC, match := hmac.SHA256HMACVerify(authkey, dlFrame.AUTHDATA, dlFrame.MAC); !match {
+						if expectedMAC, match := verifyMAC(keys.SIK, dlFrame.AUTHDATA, dlFrame.MAC); !match {
 							// MAC verification fails, drop
 							fmt.Println("failed MAC verification, MPDU:", hex.EncodeToString(dlFrame.AUTHDATA),
 								"expected:", hex.EncodeToString(expectedMAC))
 							return
 						}
 
-						dap := dlFrame.PAYLOAD
-						if !ecdh.CheckPublic(dap) {
-							// drop
-							fmt.Println("received invalid public key:", hex.EncodeToString(dap))
+						if len(dlFrame.PAYLOAD) < 4 {
+							fmt.Println("received application data without counter")
 							return
 						}
-						db, _ := ecdh.GeneratePrivate()
-						dbp := ecdh.GeneratePublic(db)
-						zz, _ := ecdh.GenerateSecret(db, dap)
-
-						// generate keys from SHA256
-						KEYS := sha256.Sum256(zz)
-
-						// construct return MPDU
-						ulFrame := UL_FRAME{auth: true}
-						ulMid := []byte{}
-
-						if mID == 0x03 {
-							ulMid = []byte{0x04}
-							S = KEYS[:16]
-							AK = KEYS[16:]
-							fmt.Println("For sensor address:", hex.EncodeToString(dlFrame.DSTADDR),
-								"created LTSS:", hex.EncodeToString(S), hex.EncodeToString(AK))
-						} else {
-							ulMid = []byte{0x06}
-							SIK = KEYS[:16]
-							SCK = KEYS[16:]
-							COUNTER = 0
-							fmt.Println("For sensor address:", hex.EncodeToString(dlFrame.DSTADDR),
-								"created session keys:", hex.EncodeToString(SIK), hex.EncodeToString(SCK))
+						payload = dlFrame.PAYLOAD[4:]
+						if session.downlinkPolicy() == 0x01 {
+							var err error
+							if payload, err = decrypt(keys.SCK, payload); err != nil {
+								fmt.Println("error decrypting application data:", err.Error())
+								return
+							}
 						}
+					}
+					fmt.Println("received application data:", hex.EncodeToString(payload))
+					select {
+					case appDlCh <- payload:
+					case <-appStopped:
+						fmt.Println("app stopped, dropped application data")
+					}
 
-						ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
-							dlFrame.DSTPAN, dlFrame.DSTADDR, ulMid, dbp, authkey)
-						IND := MakeWDCInd(ulFrame.FRAME, trail)
+				// generate NIK / unauth ecdh
+				case 0x01:
+					dap := wdcReq.MSDU[1:]
+					if !ecdh.CheckPublic(dap) {
+						// drop
+						fmt.Println("received invalid public key:", hex.EncodeToString(dap))
+						return
+					}
+					charge(energy.ECDH, 1)
+					db, _ := ecdh.GeneratePrivateFrom(keyRand)
+					dbp := ecdh.GeneratePublic(db)
+					zz, _ := ecdh.GenerateSecret(db, dap)
+					fmt.Println("shared secret:", hex.EncodeToString(zz))
+
+					zz_h := sha256.Sum256(zz)
+					NIK := zz_h[:16] // NIK := first 128 bits / 16 Bytes of the hash of the secret
+					session.update(func(keys *Keys) { keys.NIK = NIK })
+					fmt.Println("For sensor address:", hex.EncodeToString(wdcReq.DSTADDR),
+						"generated NIK:", hex.EncodeToString(NIK))
+
+					// the MPDU of the return message
+					MPDU := MakeMPDU([]byte{0x01, 0x98}, // FCF MAC data
+						[]byte{0xff, 0xff}, []byte{0xff, 0xff},
+						wdcReq.DSTPAN, wdcReq.DSTADDR,
+						append([]byte{0x02}, // mID NIK response
+							dbp...))
+
+					IND := MakeWDCInd(MPDU, node.Link.Trailer())
+
+					clock.Sleep(500 * time.Millisecond) // delay to give the server time to react
+
+					sendInd(r, IND)
+
+				// generate LTSS or generate session keys / auth ecdh
+				case 0x03, 0x05:
+					authkey := make([]byte, 16)
+					if mID == 0x03 {
+						copy(authkey, keys.NIK)
+					} else {
+						copy(authkey, keys.AK)
+					}
+					// ltss, sessionkey / auth ecdh
+					dlFrame := DL_AUTH_FRAME{}
+					if err := dlFrame.MakeDownlinkFrame(wdcReq); err != nil {
+						fmt.Println("invalid downlink frame:", err.Error())
+						return
+					}
 
-						time.Sleep(500 * time.Millisecond) // delay to give the server time to react
+					if expectedMAC, match := verifyMAC(authkey, dlFrame.AUTHDATA, dlFrame.MAC); !match {
+						// MAC verification fails, drop
+						fmt.Println("failed MAC verification, MPDU:", hex.EncodeToString(dlFrame.AUTHDATA),
+							"expected:", hex.EncodeToString(expectedMAC))
+						return
+					}
 
-						mutex.Lock()
-						ulCh <- IND
-						mutex.Unlock()
-						fmt.Println("sent WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
+					dap := dlFrame.PAYLOAD
+					if !ecdh.CheckPublic(dap) {
+						// drop
+						fmt.Println("received invalid public key:", hex.EncodeToString(dap))
+						return
+					}
+					charge(energy.ECDH, 1)
+					db, _ := ecdh.GeneratePrivateFrom(keyRand)
+					dbp := ecdh.GeneratePublic(db)
+					zz, _ := ecdh.GenerateSecret(db, dap)
 
-					// update SBK
-					case 0x07:
-						dlFrame := DL_AUTH_FRAME{}
-						dlFrame.MakeDownlinkFrame(wdcReq)
+					// generate keys from SHA256
+					KEYS := sha256.Sum256(zz)
 
-						if expectedMAC, match := hmac.SHA256HMACVerify(SIK, dlFrame.AUTHDATA, dlFrame.MAC); !match {
-							// MAC verification fails, drop
-							fmt.Println("failed MAC verification, MPDU:", hex.EncodeToString(dlFrame.AUTHDATA),
-								"expected:", hex.EncodeToString(expectedMAC))
-							return
-						}
+					// construct return MPDU
+					ulFrame := UL_FRAME{auth: true}
+					ulMid := []byte{}
 
-						sbk, err := blockcipher.AESDecryptCBCPKCS7(SCK, dlFrame.PAYLOAD)
-						if err != nil {
-							fmt.Println("error decrypting SBK:", err.Error())
-							return
-						}
+					if mID == 0x03 {
+						ulMid = []byte{0x04}
+						session.update(func(keys *Keys) { keys.S, keys.AK = KEYS[:16], KEYS[16:] })
 						fmt.Println("For sensor address:", hex.EncodeToString(dlFrame.DSTADDR),
-							"got SBK:", hex.EncodeToString(sbk))
-
-						// construct return MPDU
-						ulFrame := UL_FRAME{auth: true}
-						ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
-							dlFrame.DSTPAN, dlFrame.DSTADDR, []byte{0x08}, // mID SBK update response
-							[]byte{0x00}, // status OK
-							SIK)
-						IND := MakeWDCInd(ulFrame.FRAME, trail)
+							"created LTSS:", hex.EncodeToString(KEYS[:16]), hex.EncodeToString(KEYS[16:]))
+					} else {
+						ulMid = []byte{0x06}
+						session.updateSessionKeys(KEYS[:16], KEYS[16:])
+						fmt.Println("For sensor address:", hex.EncodeToString(dlFrame.DSTADDR),
+							"created session keys:", hex.EncodeToString(KEYS[:16]), hex.EncodeToString(KEYS[16:]))
+					}
 
-						time.Sleep(500 * time.Millisecond) // delay to give the server time to react
+					ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
+						dlFrame.DSTPAN, dlFrame.DSTADDR, ulMid, dbp, authkey)
+					sign(ulFrame)
+					IND := MakeWDCInd(ulFrame.FRAME, node.Link.Trailer())
 
-						mutex.Lock()
-						ulCh <- IND
-						mutex.Unlock()
-						fmt.Println("sent WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
+					clock.Sleep(500 * time.Millisecond) // delay to give the server time to react
 
-					// update sensor nodes security policy
-					case 0x0B:
-						dlFrame := DL_AUTH_FRAME{}
-						dlFrame.MakeDownlinkFrame(wdcReq)
+					sendInd(r, IND)
 
-						if expectedMAC, match := hmac.SHA256HMACVerify(SIK, dlFrame.AUTHDATA, dlFrame.MAC); !match {
-							// MAC verification fails, drop
-							fmt.Println("failed MAC verification, MPDU:", hex.EncodeToString(dlFrame.AUTHDATA),
-								"expected:", hex.EncodeToString(expectedMAC))
-							return
-						}
-
-						fmt.Println("For sensor address:", hex.EncodeToString(dlFrame.DSTADDR),
-							"got policy:", hex.EncodeToString(dlFrame.PAYLOAD))
-						// DL_POLICY = dlFrame.PAYLOAD[0]
-						UL_POLICY = dlFrame.PAYLOAD[1]
+				// update SBK
+				case 0x07:
+					dlFrame := DL_AUTH_FRAME{}
+					if err := dlFrame.MakeDownlinkFrame(wdcReq); err != nil {
+						fmt.Println("invalid downlink frame:", err.Error())
+						return
+					}
 
-						// construct return MPDU
-						ulFrame := UL_FRAME{auth: true}
-						ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
-							dlFrame.DSTPAN, dlFrame.DSTADDR, []byte{0x0C}, // mID policy update response
-							[]byte{0x00}, // status OK
-							SIK)
-						IND := MakeWDCInd(ulFrame.FRAME, trail)
+					if expectedMAC, match := verifyMAC(keys.SIK, dlFrame.AUTHDATA, dlFrame.MAC); !match {
+						// MAC verification fails, drop
+						fmt.Println("failed MAC verification, MPDU:", hex.EncodeToString(dlFrame.AUTHDATA),
+							"expected:", hex.EncodeToString(expectedMAC))
+						return
+					}
 
-						time.Sleep(500 * time.Millisecond) // delay to give the server time to react
+					sbk, err := decrypt(keys.SCK, dlFrame.PAYLOAD)
+					if err != nil {
+						fmt.Println("error decrypting SBK:", err.Error())
+						return
+					}
+					fmt.Println("For sensor address:", hex.EncodeToString(dlFrame.DSTADDR),
+						"got SBK:", hex.EncodeToString(sbk))
+
+					// construct return MPDU
+					ulFrame := UL_FRAME{auth: true}
+					ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
+						dlFrame.DSTPAN, dlFrame.DSTADDR, []byte{0x08}, // mID SBK update response
+						[]byte{0x00}, // status OK
+						keys.SIK)
+					sign(ulFrame)
+					IND := MakeWDCInd(ulFrame.FRAME, node.Link.Trailer())
+
+					clock.Sleep(500 * time.Millisecond) // delay to give the server time to react
+
+					sendInd(r, IND)
+
+				// update sensor nodes security policy
+				case 0x0B:
+					dlFrame := DL_AUTH_FRAME{}
+					if err := dlFrame.MakeDownlinkFrame(wdcReq); err != nil {
+						fmt.Println("invalid downlink frame:", err.Error())
+						return
+					}
 
-						mutex.Lock()
-						ulCh <- IND
-						mutex.Unlock()
-						fmt.Println("sent WDC_MAC_DATA_IND:", hex.EncodeToString(IND))
+					if expectedMAC, match := verifyMAC(keys.SIK, dlFrame.AUTHDATA, dlFrame.MAC); !match {
+						// MAC verification fails, drop
+						fmt.Println("failed MAC verification, MPDU:", hex.EncodeToString(dlFrame.AUTHDATA),
+							"expected:", hex.EncodeToString(expectedMAC))
+						return
+					}
 
-					default:
-						fmt.Println("received wrong mID")
-						// drop
+					fmt.Println("For sensor address:", hex.EncodeToString(dlFrame.DSTADDR),
+						"got policy:", hex.EncodeToString(dlFrame.PAYLOAD))
+					if len(dlFrame.PAYLOAD) < 2 {
+						fmt.Println("received incomplete policy")
 						return
 					}
+					session.setPolicies(dlFrame.PAYLOAD[0], dlFrame.PAYLOAD[1])
+
+					// construct return MPDU
+					ulFrame := UL_FRAME{auth: true}
+					ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
+						dlFrame.DSTPAN, dlFrame.DSTADDR, []byte{0x0C}, // mID policy update response
+						[]byte{0x00}, // status OK
+						keys.SIK)
+					sign(ulFrame)
+					IND := MakeWDCInd(ulFrame.FRAME, node.Link.Trailer())
+
+					clock.Sleep(500 * time.Millisecond) // delay to give the server time to react
+
+					sendInd(r, IND)
+
+				default:
+					fmt.Println("received wrong mID")
+					// drop
+					return
+				}
+			}
+		}()
+	}
+
+LOOP:
+	for {
+		select {
+		case appData := <-crossCh: // allow application to send misc data
+			copy(nfcData, appData) // do nothing, just store
+
+		case payload, more := <-appUl:
+			if !more {
+				stopApp()
+				return fmt.Errorf("app stopped")
+			}
+
+			// uplink
+			ulFrame := UL_FRAME{auth: secure}
+			if secure {
+				keys, counter, policy := session.nextUplink()
+				COUNTER_BYTE := make([]byte, 4)
+				binary.BigEndian.PutUint32(COUNTER_BYTE, counter)
+
+				var procMSDU []byte
+				if policy == 0x01 {
+					charge(energy.AES, len(payload))
+					procMSDU, _ = blockcipher.AESEncryptCBCPKCS7From(ivs, keys.SCK, payload)
+				} else {
+					procMSDU = payload
 				}
+
+				ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
+					node.PAN,     // sensor pan
+					nodeAddr,     // sensor addr
+					[]byte{0x09}, // mID unicast
+					append(COUNTER_BYTE, procMSDU...), keys.SIK)
+
+			} else {
+				keys := session.Keys()
+				ulFrame.MakeUplinkFrame([]byte{0xff, 0xff}, []byte{0xff, 0xff}, // WDC
+					node.PAN,          // sensor pan
+					nodeAddr,          // sensor addr
+					[]byte{0x09},      // mID unicast
+					payload, keys.SIK) // SIK is not actually used here
+			}
+
+			sign(ulFrame)
+			IND := MakeWDCInd(ulFrame.FRAME, node.Link.Trailer())
+
+			// retransmitted in its own goroutine, downlinks and polls go on meanwhile
+			r := node.Rand.New()
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sendInd(r, IND)
 			}()
 
+		case buf, more := <-dlCh:
+			if !more {
+				break LOOP // stop goroutine no more data
+			}
+
+			wdcReq := WDC_REQ{}
+			if err := wdcReq.ParseWDCReq(buf); err != nil {
+				fmt.Println("invalid data request:", err.Error())
+				continue
+			}
+
+			indirect := sleepy && !wdcReq.Broadcast()
+			if len(wdcReq.MSDU) == 0 || wdcReq.MSDULEN != len(wdcReq.MSDU) {
+				if len(wdcReq.MSDU) == 0 {
+					fmt.Println("zero length MSDU")
+				} else {
+					fmt.Println("MSDU length mismatch, on frame:", wdcReq.MSDULEN, ", received:", len(wdcReq.MSDU))
+				}
+				if wdcReq.ACKREQ || indirect {
+					sendUl(MakeDataCon(wdcReq.HANDLE, MAC_INVALID_PARAMETER))
+				}
+				continue
+			}
+
+			if indirect {
+				if len(queue) == MAX_PENDING {
+					fmt.Println("too many pending data requests, dropped")
+					sendUl(MakeDataCon(wdcReq.HANDLE, MAC_TRANSACTION_OVERFLOW))
+					continue
+				}
+				queue = append(queue, transaction{buf, wdcReq, clock.Now().Add(persistence)})
+				if len(queue) == 1 {
+					expire = clock.After(persistence)
+				}
+				fmt.Println("data request queued until polled, pending:", len(queue))
+				continue
+			}
+
+			process(buf, wdcReq, false)
+
+		case <-poll:
+			poll = clock.After(node.Sleep.Poll)
+			for {
+				// the node wakes up and asks for its downlinks
+				cmd := MakeDataRequestCmd(node.PAN, nodeAddr)
+				if !charge(energy.TX, len(cmd)) {
+					break
+				}
+				fmt.Println("sent data request command:", hex.EncodeToString(cmd))
+				if node.Link.Lost(node.Rand) || !charge(energy.RX, len(MakePollAck(0x00, false))) {
+					fmt.Println("lost data request command")
+					break
+				}
+				fmt.Println("sent acknowledgement frame:", hex.EncodeToString(MakePollAck(0x00, len(queue) > 0)))
+				if len(queue) == 0 {
+					break
+				}
+
+				t := queue[0]
+				queue = queue[1:]
+				if !t.req.ACKREQ {
+					// confirmed in order, once the node has received it
+					if !charge(energy.RX, len(t.req.MSDU)+13) {
+						sendUl(MakeDataCon(t.req.HANDLE, MAC_TRANSACTION_EXPIRED)) // never picked up
+						break
+					}
+					sendUl(MakeDataCon(t.req.HANDLE, MAC_SUCCESS))
+				}
+				process(t.buf, t.req, !t.req.ACKREQ)
+				if len(queue) == 0 {
+					break // frame pending bit not set, back to sleep
+				}
+			}
+			expire = nextExpiry()
+
+		case <-expire:
+			for len(queue) > 0 && !queue[0].expires.After(clock.Now()) {
+				fmt.Println("data request expired:", hex.EncodeToString(queue[0].buf))
+				sendUl(MakeDataCon(queue[0].req.HANDLE, MAC_TRANSACTION_EXPIRED))
+				queue = queue[1:]
+			}
+			expire = nextExpiry()
+
+		case err := <-errCh:
+			return err
 		}
 	}
-	fmt.Println("node processor stopped")
+	return nil
 }
@@ -0,0 +1,344 @@
+package worker
+
+import (
+	"bytes"
+	"context"
+	"github.com/herrfz/coordnode/app"
+	"github.com/herrfz/coordnode/clock"
+	"github.com/herrfz/coordnode/energy"
+	"github.com/herrfz/coordnode/rng"
+	"github.com/herrfz/coordnode/serialport"
+	"testing"
+	"time"
+)
+
+func TestDoDataRequestMalformed(t *testing.T) {
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca}}
+
+	// app stopping when the worker closes appDlCh
+	go func() {
+		for range appDlCh {
+		}
+		close(appUlCh)
+	}()
+
+	errCh := make(chan error)
+	go func() { errCh <- DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh) }()
+
+	for _, buf := range [][]byte{
+		{0x01, 0x17},
+		{0x0a, 0x17, 0x01, 0x20, 0xb1, 0xca, 0x01, 0x00, 0x01, 0x04},             // disassociation without reason
+		{0x0b, 0x17, 0x01, 0x00, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x01, 0x00},       // short public key
+		{0x0c, 0x17, 0x01, 0x00, 0xb1, 0xca, 0x01, 0x00, 0x03, 0x0b, 0x00, 0x00}, // policy without MAC
+	} {
+		dlCh <- buf
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(dlCh)
+
+	if err := <-errCh; err != nil {
+		t.Errorf("worker failed: %v", err.Error())
+	}
+	if _, more := <-ulCh; more {
+		t.Errorf("uplink channel not closed")
+	}
+}
+
+func TestDoDataRequestAck(t *testing.T) {
+	tests := []struct {
+		link   LinkModel
+		ack    AckModel
+		status byte
+		app    bool // payload delivered to the app
+	}{
+		{StaticLink{}, AckModel{}, MAC_SUCCESS, true},
+		{StaticLink{Loss: 1}, AckModel{Retries: 2}, MAC_NO_ACK, false},
+		{StaticLink{}, AckModel{Loss: 1, Retries: 1}, MAC_NO_ACK, true},
+	}
+	for _, test := range tests {
+		dlCh, ulCh := make(chan []byte), make(chan []byte)
+		appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+		node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+			Link: test.link, Ack: test.ack}
+
+		delivered := make(chan bool, 1)
+		go func() {
+			got := false
+			for range appDlCh {
+				got = true
+			}
+			delivered <- got
+			close(appUlCh)
+		}()
+		go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+
+		dlCh <- []byte{0x0b, 0x17, 0x2a, ACK_REQUESTED, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42} // application data
+		if con := <-ulCh; !bytes.Equal(con, MakeDataCon(0x2a, test.status)) {
+			t.Errorf("wrong output: %x, expected: %x", con, MakeDataCon(0x2a, test.status))
+		}
+		close(dlCh)
+		for range ulCh {
+		}
+		if got := <-delivered; got != test.app {
+			t.Errorf("wrong output: %v, expected: %v", got, test.app)
+		}
+	}
+}
+
+func TestDoDataRequestUplinkRetries(t *testing.T) {
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+		Link: StaticLink{}, Ack: AckModel{Uplink: true, Loss: 1, Retries: 2}}
+	session := NewSession(node.Keys)
+	node.Session = session
+
+	go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+	appUlCh <- []byte{0x42}
+
+	// the acknowledgement is always lost: sent once and retransmitted twice
+	for i := 0; i < 3; i++ {
+		select {
+		case <-ulCh:
+		case <-time.After(time.Second):
+			t.Fatalf("wrong number of uplinks: %v, expected: 3", i)
+		}
+	}
+	close(appUlCh)
+	for range ulCh {
+	}
+	if sent, received, _ := session.Counters(); sent != 3 || received != 3 {
+		t.Errorf("wrong output: %v %v, expected: 3 3", sent, received)
+	}
+}
+
+// a downlink is taken while an uplink waits to be retransmitted
+func TestDoDataRequestUplinkBackoff(t *testing.T) {
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+		Link: StaticLink{}, Ack: AckModel{Uplink: true, Loss: 1, Retries: 1, Backoff: 100 * time.Millisecond}}
+	delivered := make(chan bool, 1)
+	go func() {
+		for range appDlCh {
+			delivered <- true
+		}
+	}()
+	go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+
+	appUlCh <- []byte{0x42}
+	<-ulCh
+	// the retransmission is not read yet, it would block a busy worker
+	select {
+	case dlCh <- []byte{0x0b, 0x17, 0x01, 0x00, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}:
+	case <-time.After(time.Second):
+		t.Fatalf("downlink not taken during the uplink backoff")
+	}
+	<-ulCh
+	select {
+	case <-delivered:
+	case <-time.After(time.Second):
+		t.Errorf("downlink not delivered")
+	}
+
+	close(appUlCh)
+	for range ulCh {
+	}
+}
+
+func TestDoDataRequestIndirect(t *testing.T) {
+	appData := func(handle byte) []byte {
+		return []byte{0x0b, 0x17, handle, 0x00, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}
+	}
+	tests := []struct {
+		sleep    SleepModel
+		requests int
+		statuses []byte
+	}{
+		// both sent on one wake up, the first with the frame pending bit
+		{SleepModel{Poll: 20 * time.Millisecond, Persistence: time.Hour}, 2, []byte{MAC_SUCCESS, MAC_SUCCESS}},
+		{SleepModel{Poll: time.Hour, Persistence: 20 * time.Millisecond}, 1, []byte{MAC_TRANSACTION_EXPIRED}},
+	}
+	for _, test := range tests {
+		dlCh, ulCh := make(chan []byte), make(chan []byte)
+		appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+		node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+			Sleep: test.sleep}
+		go func() {
+			for range appDlCh {
+			}
+			close(appUlCh)
+		}()
+		go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+
+		for i := 0; i < test.requests; i++ {
+			dlCh <- appData(byte(i))
+		}
+		for i, status := range test.statuses {
+			if con := <-ulCh; !bytes.Equal(con, MakeDataCon(byte(i), status)) {
+				t.Errorf("wrong output: %x, expected: %x", con, MakeDataCon(byte(i), status))
+			}
+		}
+		close(dlCh)
+		for range ulCh {
+		}
+	}
+
+	// the queue is full, and what is left expires when the node stops
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+		Sleep: SleepModel{Poll: time.Hour}}
+	go func() {
+		for range appDlCh {
+		}
+		close(appUlCh)
+	}()
+	go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+	for i := 0; i < MAX_PENDING; i++ {
+		dlCh <- appData(byte(i))
+	}
+	go func() {
+		dlCh <- appData(MAX_PENDING)
+		close(dlCh)
+	}()
+	if con := <-ulCh; !bytes.Equal(con, MakeDataCon(MAX_PENDING, MAC_TRANSACTION_OVERFLOW)) {
+		t.Errorf("wrong output: %x, expected: %x", con, MakeDataCon(MAX_PENDING, MAC_TRANSACTION_OVERFLOW))
+	}
+	expired := 0
+	for con := range ulCh {
+		if con[3] == MAC_TRANSACTION_EXPIRED {
+			expired++
+		}
+	}
+	if expired != MAX_PENDING {
+		t.Errorf("wrong output: %v, expected: %v", expired, MAX_PENDING)
+	}
+}
+
+// the battery lasts for the poll but not for the downlink it brings
+func TestDoDataRequestPolledDepleted(t *testing.T) {
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	battery := energy.Battery{Capacity: 20 / (3.6 * 2500 * 1000), Full: 3000, Empty: 2000} // 20µJ
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+		Sleep: SleepModel{Poll: 20 * time.Millisecond, Persistence: time.Hour}, Energy: energy.NewMeter(battery, energy.Costs{RX: 1}, true)}
+	go func() {
+		for range appDlCh {
+			t.Errorf("delivered to a dead node")
+		}
+		close(appUlCh)
+	}()
+	go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+
+	dlCh <- []byte{0x0b, 0x17, 0x2a, 0x00, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}
+	if con := <-ulCh; !bytes.Equal(con, MakeDataCon(0x2a, MAC_TRANSACTION_EXPIRED)) {
+		t.Errorf("wrong output: %x, expected: %x", con, MakeDataCon(0x2a, MAC_TRANSACTION_EXPIRED))
+	}
+	close(dlCh)
+	for range ulCh {
+	}
+}
+
+func TestDoDataRequestDepleted(t *testing.T) {
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+		Energy: energy.NewMeter(energy.Battery{Capacity: 1e-9, Full: 3000, Empty: 2000}, energy.DefaultCosts, false)}
+	go func() {
+		for range appDlCh {
+		}
+	}()
+	go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+
+	// a dead node neither sends nor acknowledges
+	appUlCh <- []byte{0x42}
+	dlCh <- []byte{0x0b, 0x17, 0x01, ACK_REQUESTED, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}
+	if con := <-ulCh; !bytes.Equal(con, MakeDataCon(0x01, MAC_NO_ACK)) {
+		t.Errorf("wrong output: %x, expected: %x", con, MakeDataCon(0x01, MAC_NO_ACK))
+	}
+	close(appUlCh)
+	for buf := range ulCh {
+		t.Errorf("sent by a dead node: %x", buf)
+	}
+}
+
+// sends n uplinks of random payload at random times, then closes sent
+type randomApp struct {
+	n    int
+	sent chan bool
+}
+
+func (a randomApp) Start(ctx context.Context, node app.NodeContext) error {
+	defer close(a.sent)
+	for i := 0; i < a.n; i++ {
+		select {
+		case <-clock.After(time.Duration(node.Rand().Intn(1000)) * time.Millisecond):
+		case <-ctx.Done():
+			return nil
+		}
+		if err := node.SendUplink([]byte{byte(node.Rand().Intn(256))}); err != nil {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (a randomApp) OnDownlink(payload []byte) {}
+
+// capture of a lossy, encrypting node and its app in virtual time
+func runSeeded(t *testing.T, seed int64) []byte {
+	clock.Set(clock.NewVirtual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)))
+	defer clock.Set(clock.Real)
+	rng.Seed(seed)
+
+	dlCh, ulCh := make(chan []byte), make(chan []byte)
+	appDlCh, appUlCh, crossCh := make(chan []byte), make(chan []byte), make(chan []byte)
+	keys := Keys{SIK: bytes.Repeat([]byte{0x11}, 16), SCK: bytes.Repeat([]byte{0x22}, 16)}
+	node := NodeConfig{Addr: []byte{0x01, 0x00}, EUI: MakeEUI64([]byte{0x02, 0x00, 0x00}, 1), PAN: []byte{0xb1, 0xca},
+		Secure: true, ULPolicy: 0x01, Keys: keys, Link: StaticLink{Loss: 0.3},
+		Ack:  AckModel{Uplink: true, Loss: 0.3, Retries: 3, Backoff: 10 * time.Millisecond},
+		Rand: rng.New(), AppRand: rng.New(), KeyRand: rng.New()}
+	node.Session = NewSession(node.Keys)
+
+	out := &bytes.Buffer{}
+	c, err := NewCapture(out)
+	if err != nil {
+		t.Fatalf("error creating capture: %v", err.Error())
+	}
+	captured := make(chan bool)
+	go func() {
+		w := c.Writer(&bytes.Buffer{})
+		for buf := range ulCh {
+			w.Write(buf)
+		}
+		close(captured)
+	}()
+
+	a := randomApp{n: 5, sent: make(chan bool)}
+	appErr := make(chan error)
+	go func() { appErr <- RunApp(a, node, serialport.Config{}, appDlCh, appUlCh, crossCh) }()
+	go DoDataRequest(node, dlCh, ulCh, appDlCh, appUlCh, crossCh)
+
+	// the downlink once the uplinks are sent, so that it does not race them
+	<-a.sent
+	dlCh <- []byte{0x0b, 0x17, 0x2a, ACK_REQUESTED, 0xb1, 0xca, 0x01, 0x00, 0x02, 0x09, 0x42}
+	close(dlCh)
+	<-captured
+	if err := <-appErr; err != nil {
+		t.Errorf("app failed: %v", err.Error())
+	}
+	return out.Bytes()
+}
+
+func TestDoDataRequestSeeded(t *testing.T) {
+	first, second, other := runSeeded(t, 42), runSeeded(t, 42), runSeeded(t, 43)
+	if !bytes.Equal(first, second) {
+		t.Errorf("wrong output: %x, expected: %x", second, first)
+	}
+	if bytes.Equal(first, other) {
+		t.Errorf("seeds 42 and 43 give the same capture: %x", first)
+	}
+}
@@ -0,0 +1,52 @@
+package worker
+
+import "time"
+
+// status of WDC_MAC_DATA_CON for indirect transmissions
+const (
+	MAC_TRANSACTION_EXPIRED  = 0xf0
+	MAC_TRANSACTION_OVERFLOW = 0xf1
+)
+
+// downlinks queued for a sleeping node at most
+const MAX_PENDING = 7
+
+// FCF frame pending bit, set by the coordinator while more downlinks are queued
+const FCF_FRAME_PENDING = 0x10
+
+// SleepModel makes a node sleep between polls: the coordinator queues its
+// unicast downlinks, and sends one of them on every data request MAC command
+// of the node, which polls again at once while the frame pending bit is set
+type SleepModel struct {
+	Poll        time.Duration // between wake ups, 0 if the node is always on
+	Persistence time.Duration // macTransactionPersistenceTime, a queued downlink expires after
+}
+
+// 802.15.4 default, 0x01f4 unit superframes of 15.36ms
+const DEFAULT_PERSISTENCE = 7680 * time.Millisecond
+
+// data request waiting for the node to poll
+type transaction struct {
+	buf     []byte
+	req     WDC_REQ
+	expires time.Time
+}
+
+// data request MAC command frame of a node, sent to the coordinator
+func MakeDataRequestCmd(pan, srcaddr []byte) []byte {
+	fcf := []byte{0x04, 0x98} // FCF MAC command, as the association request
+	if len(srcaddr) == 8 {
+		fcf[1] |= FCF_SRC_LONG
+	}
+	return MakeMPDU(fcf, []byte{0xff, 0xff}, []byte{0xff, 0xff}, pan, srcaddr, []byte{0x04})
+}
+
+// acknowledgement of a data request MAC command, telling whether the
+// coordinator has data pending for the node
+func MakePollAck(seq byte, pending bool) []byte {
+	ack := MakeAckFrame(seq)
+	if pending {
+		ack[0] |= FCF_FRAME_PENDING
+	}
+	return ack
+}
@@ -0,0 +1,130 @@
+package worker
+
+import (
+	"github.com/herrfz/coordnode/radio"
+	"github.com/herrfz/coordnode/rng"
+)
+
+// radio link between a node and the coordinator
+type LinkModel interface {
+	Trailer() []byte                   // LQI, ED, RX status, RX slot, as appended to WDC_MAC_DATA_IND
+	Lost(r *rng.Rand) bool             // whether an uplink frame is lost on the air
+	Corrupted(r *rng.Rand) bool        // whether an uplink frame that is not lost has bit errors
+	EnergyDetect() byte                // energy on the channel as measured by the node
+	Signal() (power float64, slot int) // dBm of the uplinks at the coordinator, TDMA slot of the node
+}
+
+// link with fixed quality and independent, uniformly distributed losses
+type StaticLink struct {
+	LQI, ED byte
+	Loss    float64
+}
+
+func (l StaticLink) Trailer() []byte {
+	return []byte{l.LQI, l.ED, 0x96, 0x00, 0x00}
+}
+
+func (l StaticLink) Lost(r *rng.Rand) bool {
+	return l.Loss > 0 && r.Float64() < l.Loss
+}
+
+func (l StaticLink) Corrupted(r *rng.Rand) bool {
+	return false
+}
+
+func (l StaticLink) EnergyDetect() byte {
+	return l.ED
+}
+
+func (l StaticLink) Signal() (float64, int) {
+	return radio.PowerFromLQI(l.LQI), 0
+}
+
+// link of a node at a position sending in a slot, degraded by the jammers of
+// the medium it shares with the other nodes
+type JammedLink struct {
+	StaticLink // quality without interference
+	Medium     *radio.Medium
+	Position   radio.Point
+	Slot       int
+}
+
+func (l JammedLink) quality() radio.Quality {
+	return l.Medium.Quality(l.LQI, l.ED, l.Loss, l.Position, l.Slot)
+}
+
+func (l JammedLink) Trailer() []byte {
+	return trailer(l.quality())
+}
+
+func (l JammedLink) Lost(r *rng.Rand) bool {
+	return lost(r, l.quality())
+}
+
+func (l JammedLink) Corrupted(r *rng.Rand) bool {
+	return corrupted(r, l.quality())
+}
+
+func (l JammedLink) EnergyDetect() byte {
+	if e := l.Medium.EnergyDetect(l.Position); e > l.ED {
+		return e
+	}
+	return l.ED
+}
+
+func (l JammedLink) Signal() (float64, int) {
+	return radio.PowerFromLQI(l.LQI), l.Slot
+}
+
+// link of a node whose quality follows from its distance to the coordinator
+// and the walls in between, as the node moves along its trace
+type RadioLink struct {
+	Medium *radio.Medium
+	Node   radio.Transmitter
+	Loss   float64 // besides the losses of the radio channel
+}
+
+func (l RadioLink) quality() radio.Quality {
+	return l.Medium.Uplink(l.Node, l.Loss)
+}
+
+func (l RadioLink) Trailer() []byte {
+	return trailer(l.quality())
+}
+
+func (l RadioLink) Lost(r *rng.Rand) bool {
+	return lost(r, l.quality())
+}
+
+func (l RadioLink) Corrupted(r *rng.Rand) bool {
+	return corrupted(r, l.quality())
+}
+
+func (l RadioLink) EnergyDetect() byte {
+	return l.Medium.EnergyDetect(l.Medium.Position(l.Node))
+}
+
+func (l RadioLink) Signal() (float64, int) {
+	return l.Medium.Received(l.Node), l.Node.Slot
+}
+
+func trailer(q radio.Quality) []byte {
+	return []byte{q.LQI, q.ED, 0x96, 0x00, 0x00}
+}
+
+func lost(r *rng.Rand, q radio.Quality) bool {
+	return q.Lost > 0 && r.Float64() < q.Lost
+}
+
+func corrupted(r *rng.Rand, q radio.Quality) bool {
+	return q.Corrupt > 0 && r.Float64()*(1-q.Lost) < q.Corrupt
+}
+
+// flip a random bit of the MPDU of a WDC_MAC_DATA_IND, after its PHR and
+// before the 5 bytes trailer
+func corruptInd(r *rng.Rand, IND []byte) {
+	if len(IND) > 3+5 {
+		mpdu := IND[3 : len(IND)-5]
+		mpdu[r.Intn(len(mpdu))] ^= 1 << uint(r.Intn(8))
+	}
+}
@@ -0,0 +1,121 @@
+package worker
+
+import (
+	"github.com/herrfz/coordnode/energy"
+	"github.com/herrfz/coordnode/radio"
+	"github.com/herrfz/coordnode/rng"
+	"io"
+	"sync"
+)
+
+// keys of a node; nil keys are established over the air
+type Keys struct {
+	NIK, S, AK, SIK, SCK []byte
+}
+
+// static configuration of an emulated node
+type NodeConfig struct {
+	Addr     []byte // short address, little endian
+	EUI      []byte // EUI-64, canonical byte order
+	PAN      []byte // PAN identifier, frame byte order
+	Secure   bool   // apply security processing
+	ULPolicy byte   // initial uplink policy, 0x01 encrypts application data
+	Keys     Keys
+	Link     LinkModel
+	Ack      AckModel
+	Sleep    SleepModel
+	Energy   *energy.Meter  // battery of the node, never depleted if nil
+	Channel  *radio.Channel // shared with the other nodes, uplinks never collide if nil
+	Session  *Session       // keys shared with the app, created from Keys if nil
+	Rand     *rng.Rand      // draws of the worker, from the global source if nil
+	AppRand  *rng.Rand      // draws of the app, from the global source if nil
+	KeyRand  *rng.Rand      // seeds insecure DRBGs for the keys and IVs, crypto/rand if nil
+}
+
+// source of the keys and IVs of one goroutine of the worker; nil for the
+// sources of the crypto packages
+func (node NodeConfig) keyReader() io.Reader {
+	if node.KeyRand == nil {
+		return nil
+	}
+	return rng.NewInsecureDRBG(node.KeyRand.Int63())
+}
+
+// Session holds the current keys and policies of a node, updated by the key
+// exchanges of the worker and read by the app and the uplinks, and the
+// counters of the uplinks
+type Session struct {
+	mutex    sync.Mutex
+	keys     Keys
+	dlPolicy byte   // 0x01 if the application data of the downlinks is encrypted
+	ulPolicy byte   // 0x01 encrypts the application data of the uplinks
+	counter  uint32 // of the secured uplinks, since the session keys
+	sent     uint32 // uplink frames sent on the air
+	received uint32 // uplink frames received by the coordinator
+	edSum    uint64 // of the received frames
+}
+
+func NewSession(keys Keys) *Session {
+	return &Session{keys: keys}
+}
+
+func (s *Session) Keys() Keys {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.keys
+}
+
+func (s *Session) update(f func(keys *Keys)) {
+	s.mutex.Lock()
+	f(&s.keys)
+	s.mutex.Unlock()
+}
+
+// session keys restart the uplink counter
+func (s *Session) updateSessionKeys(sik, sck []byte) {
+	s.mutex.Lock()
+	s.keys.SIK, s.keys.SCK = sik, sck
+	s.counter = 0
+	s.mutex.Unlock()
+}
+
+func (s *Session) setPolicies(dl, ul byte) {
+	s.mutex.Lock()
+	s.dlPolicy, s.ulPolicy = dl, ul
+	s.mutex.Unlock()
+}
+
+func (s *Session) downlinkPolicy() byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.dlPolicy
+}
+
+// keys, next counter and policy of a secured uplink
+func (s *Session) nextUplink() (keys Keys, counter uint32, policy byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.counter++
+	return s.keys, s.counter, s.ulPolicy
+}
+
+// count an uplink frame, with the ED of its trailer if it is received
+func (s *Session) countUplink(received bool, ed byte) {
+	s.mutex.Lock()
+	s.sent++
+	if received {
+		s.received++
+		s.edSum += uint64(ed)
+	}
+	s.mutex.Unlock()
+}
+
+// uplink frames sent and received, and the mean ED of the received ones
+func (s *Session) Counters() (sent, received uint32, ed float64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.received > 0 {
+		ed = float64(s.edSum) / float64(s.received)
+	}
+	return s.sent, s.received, ed
+}
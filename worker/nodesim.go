@@ -0,0 +1,195 @@
+package worker
+
+import (
+	"bufio"
+	"encoding/hex"
+	"fmt"
+	"github.com/herrfz/coordnode/clock"
+	"io"
+	"strings"
+	"time"
+)
+
+// one scripted message of the simulated node firmware
+type SimStep struct {
+	Delay time.Duration // wait before sending, counted from the previous step
+	Msg   Message
+}
+
+// NodeSim emulates the firmware of a real node on the other end of the node
+// serial link: it answers hellos, acknowledges and receives app messages, and
+// sends the messages of its script once the first handshake is done
+type NodeSim struct {
+	Caps   byte          // capabilities the firmware accepts, 0 for legacy firmware
+	Script []SimStep     // sent once, after the first hello ack
+	Rx     chan<- []byte // data of received app messages, nil to only print them
+}
+
+// ParseSimScript reads a script, one step per line:
+//
+//	wait <duration>   delay the next message, e.g. wait 500ms
+//	app <hex>         app message, the data must be an MPDU
+//	debug <hex>       debug message
+//
+// empty lines and lines starting with # are ignored
+func ParseSimScript(r io.Reader) ([]SimStep, error) {
+	var script []SimStep
+	var delay time.Duration
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: expected command and argument", line)
+		}
+
+		switch fields[0] {
+		case "wait":
+			d, err := time.ParseDuration(fields[1])
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("line %d: invalid duration %q", line, fields[1])
+			}
+			delay += d
+
+		case "app", "debug":
+			data, err := hex.DecodeString(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("line %d: invalid hex data %q", line, fields[1])
+			}
+			mtype := MSG_APP
+			if fields[0] == "debug" {
+				mtype = MSG_DEBUG
+			}
+			script = append(script, SimStep{delay, Message{mtype, data}})
+			delay = 0
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown command %q", line, fields[0])
+		}
+	}
+	return script, scanner.Err()
+}
+
+// Run serves the port until it fails or stop is closed
+func (n NodeSim) Run(port io.ReadWriteCloser, stop <-chan bool) error {
+	linkFraming := &linkFraming{}
+	rxch, errch, done := make(chan []byte), make(chan error), make(chan bool)
+	defer close(done)
+	go readSerial(SerialReader{port, linkFraming}, rxch, errch, done)
+
+	// writes never block the loop, the worker on the other end may be writing too;
+	// write errors show up on the reader
+	txch := make(chan []byte, 64)
+	defer close(txch)
+	go func() {
+		for buf := range txch {
+			port.Write(buf)
+		}
+	}()
+	write := func(buf []byte) {
+		if buf != nil {
+			txch <- buf
+		}
+	}
+
+	framing := Framing{}
+	sender := arqSender{}
+	receiver := arqReceiver{last: -1}
+	script := n.Script
+	started := false
+	var next <-chan time.Time
+
+	for {
+		select {
+		case <-stop:
+			return nil
+
+		case err := <-errch:
+			return err
+
+		case <-sender.timeout():
+			write(sender.expire())
+
+		case <-next:
+			next = nil
+			write(sender.send(script[0].Msg))
+			fmt.Println("node sim sent message:", script[0].Msg.mtype, hex.EncodeToString(script[0].Msg.data))
+			script = script[1:]
+			if len(script) > 0 {
+				next = clock.After(script[0].Delay)
+			}
+
+		case buf := <-rxch:
+			if len(buf) > 0 && buf[0] == MSG_HELLO {
+				hello := Message{}
+				if err := hello.ParseBuffer(buf); err != nil {
+					fmt.Println("node sim received invalid hello:", err.Error())
+					continue
+				}
+
+				// legacy firmware answers with an empty ack
+				framing = Framing{}
+				ack := Message{MSG_HELLO_ACK, []byte{}}
+				if n.Caps != 0 {
+					if len(hello.data) > 0 {
+						framing.Caps = hello.data[0] & n.Caps
+					}
+					ack.data = []byte{framing.Caps}
+				}
+				linkFraming.set(framing) // before the ack, the worker answers right away
+				write(ack.GenerateMessage())
+				receiver = arqReceiver{framing: framing, last: -1}
+				write(sender.restart(framing))
+
+				if !started && len(script) > 0 {
+					started = true
+					next = clock.After(script[0].Delay)
+				}
+				continue
+			}
+
+			rcvd, seq, err := framing.Decode(buf)
+			if err != nil {
+				fmt.Println("node sim error parsing buffer:", err.Error())
+				if framing.Caps&CAP_SEQ != 0 && len(buf) > 2 {
+					write(receiver.reject(seq))
+				}
+				continue
+			}
+
+			switch rcvd.mtype {
+			case MSG_ACK:
+				write(sender.ack(seq))
+				continue
+			case MSG_NAK:
+				write(sender.nak(seq))
+				continue
+			}
+
+			if framing.Caps&CAP_SEQ != 0 {
+				ack, isNew := receiver.receive(seq)
+				write(ack)
+				if !isNew {
+					continue
+				}
+			}
+
+			switch rcvd.mtype {
+			case MSG_APP:
+				fmt.Println("node sim received application message:", hex.EncodeToString(rcvd.data))
+				if n.Rx != nil {
+					select {
+					case n.Rx <- rcvd.data:
+					case <-stop:
+						return nil
+					}
+				}
+
+			case MSG_DEBUG:
+				fmt.Println("node sim received debug message:", hex.EncodeToString(rcvd.data))
+			}
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSimScript(t *testing.T) {
+	script, err := ParseSimScript(strings.NewReader("# boot\nwait 1s\nwait 500ms\napp cafe\n\ndebug 00\n"))
+	if err != nil {
+		t.Fatalf("error parsing: %v", err.Error())
+	}
+	if len(script) != 2 || script[0].Delay != 1500*time.Millisecond || script[0].Msg.mtype != MSG_APP ||
+		!bytes.Equal(script[0].Msg.data, []byte{0xca, 0xfe}) || script[1].Delay != 0 || script[1].Msg.mtype != MSG_DEBUG {
+		t.Errorf("wrong output: %+v", script)
+	}
+
+	for _, s := range []string{"app", "app xyz", "wait soon", "reboot now"} {
+		if _, err := ParseSimScript(strings.NewReader(s)); err == nil {
+			t.Errorf("no error parsing %q", s)
+		}
+	}
+}
+
+// serial worker talking to the simulator over a pipe: the scripted uplink
+// reaches the wdc side and a data request reaches the node
+func testNodeSim(t *testing.T, caps byte) {
+	mpdu := MakeMPDU([]byte{0x01, 0x98}, []byte{0xb1, 0xca}, []byte{0x01, 0x00}, []byte{0xff, 0xff}, []byte{0xff, 0xff}, []byte{0xca, 0xfe})
+	workerEnd, simEnd := net.Pipe()
+
+	rx := make(chan []byte)
+	stop := make(chan bool)
+	sim := NodeSim{Caps: caps, Script: []SimStep{{0, Message{MSG_APP, mpdu}}}, Rx: rx}
+	go sim.Run(simEnd, stop)
+	defer close(stop)
+
+	opened := false
+	open := func() (io.ReadWriteCloser, error) {
+		if opened {
+			return nil, fmt.Errorf("already opened")
+		}
+		opened = true
+		return workerEnd, nil
+	}
+
+	dlCh, ulCh, linkCh := make(chan []byte), make(chan []byte), make(chan bool, 4)
+	go serveSerial(dlCh, ulCh, "pipe", open, linkCh)
+
+	select {
+	case ind := <-ulCh:
+		out := MakeWDCInd(mpdu, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
+		if !bytes.Equal(ind, out) {
+			t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(ind), hex.EncodeToString(out))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no indication from the node")
+	}
+
+	dlCh <- []byte{0x0b, 0x17, 0x01, 0x00, 0xb1, 0xca, 0x02, 0x00, 0x02, 0xde, 0xad}
+	select {
+	case data := <-rx:
+		out := MakeMPDU([]byte{0x01, 0x98}, []byte{0xb1, 0xca}, []byte{0x02, 0x00}, []byte{0xff, 0xff}, []byte{0xff, 0xff}, []byte{0xde, 0xad})
+		if !bytes.Equal(data, out) {
+			t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(data), hex.EncodeToString(out))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no data request at the node")
+	}
+
+	close(dlCh)
+	if _, more := <-ulCh; more {
+		t.Errorf("uplink channel not closed")
+	}
+	if up := <-linkCh; !up {
+		t.Errorf("link not reported up")
+	}
+}
+
+func TestNodeSimLegacy(t *testing.T) {
+	testNodeSim(t, 0)
+}
+
+func TestNodeSimExtended(t *testing.T) {
+	testNodeSim(t, CAP_SEQ|CAP_CRC16|CAP_LONG_LEN)
+}
@@ -4,19 +4,23 @@ import (
 	"encoding/hex"
 	"fmt"
 	msg "github.com/herrfz/coordnode/messages"
+	"sync/atomic"
 )
 
+// long address reported in the connection response, may be replaced by
+// WDC_SET_COOR_LONG_ADDR_REQ
+var CoordLongAddr = []byte{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef}
+
 // process server/wdc messages, return nil if no response shall be sent
 func ProcessMessage(buf []byte) []byte {
-	if len(buf) == 0 {
+	if len(buf) < 2 { // length and command id
 		return nil
 	}
 
 	switch buf[1] {
 	case 0x01:
 		fmt.Println("received CoordNode connect")
-		fake := []byte{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef}
-		copy(msg.WDC_CONNECTION_RES[2:], fake)
+		copy(msg.WDC_CONNECTION_RES[2:], CoordLongAddr)
 		fmt.Println("CoordNode connection created")
 		return msg.WDC_CONNECTION_RES
 
@@ -27,6 +31,9 @@ func ProcessMessage(buf []byte) []byte {
 
 	case 0x07:
 		fmt.Println("received set CorrdNode long address")
+		if len(buf) >= 10 {
+			CoordLongAddr = append([]byte{}, buf[2:10]...)
+		}
 		fmt.Println("CorrdNode long address set")
 		return msg.WDC_SET_COOR_LONG_ADDR_REQ_ACK
 
@@ -42,6 +49,7 @@ func ProcessMessage(buf []byte) []byte {
 	case 0x11: // start TDMA
 		fmt.Println("received start TDMA:", hex.EncodeToString(buf))
 		msg.WDC_GET_TDMA_RES[2] = 0x01 // running
+		atomic.StoreInt32(&tdmaRunning, 1)
 		copy(msg.WDC_GET_TDMA_RES[3:], buf[2:])
 		msg.WDC_ACK[1] = 0x12 // START_TDMA_REQ_ACK
 		fmt.Println("TDMA started")
@@ -51,6 +59,7 @@ func ProcessMessage(buf []byte) []byte {
 		fmt.Println("received stop TDMA")
 		msg.WDC_GET_TDMA_RES[2] = 0x00 // stopped
 		msg.WDC_ACK[1] = 0x14          // STOP_TDMA_REQ_ACK
+		atomic.StoreInt32(&tdmaRunning, 0)
 		fmt.Println("TDMA stopped")
 		return msg.WDC_ACK
 
@@ -61,6 +70,15 @@ func ProcessMessage(buf []byte) []byte {
 
 	case 0x17: // data request
 		fmt.Println("received data request", hex.EncodeToString(buf))
+		if len(buf) < 3 {
+			fmt.Println("data request without handle")
+			return nil
+		}
+
+		if AckRequested(buf) {
+			fmt.Println("data confirmation sent once acknowledged")
+			return nil
+		}
 
 		// send confirmation
 		msg.WDC_MAC_DATA_CON[2] = buf[2]
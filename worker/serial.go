@@ -4,10 +4,9 @@ package worker
 import (
 	"encoding/hex"
 	"fmt"
-	"github.com/herrfz/devreader"
-	"github.com/tarm/goserial"
+	"github.com/herrfz/coordnode/clock"
+	"github.com/herrfz/coordnode/transport"
 	"io"
-	"os"
 	"time"
 )
 
@@ -37,6 +36,9 @@ func (msg *Message) ParseBuffer(buf []byte) error {
 	if buflen == 0 {
 		return fmt.Errorf("received zero length message")
 	}
+	if buflen < 3 {
+		return fmt.Errorf("message too short: %d bytes", buflen)
+	}
 
 	if buf[1] != byte(buflen) {
 		return fmt.Errorf("invalid length")
@@ -49,51 +51,60 @@ func (msg *Message) ParseBuffer(buf []byte) error {
 	}
 
 	msg.mtype = int(buf[0])
-	if msg.mtype == 3 || msg.mtype == 4 {
-		msg.data = buf[2 : buflen-1]
-	} else { // hello and hello ack have no content
-		msg.data = []byte{}
-	}
+	msg.data = buf[2 : buflen-1] // hello and hello ack carry the capabilities, if any
 
 	return nil
 }
 
+// malformed message on a working port, the reader carries on with the next one
+type FramingError string
+
+func (e FramingError) Error() string {
+	return string(e)
+}
+
 type SerialReader struct {
-	serial io.ReadWriteCloser
+	serial  io.ReadWriteCloser
+	framing *linkFraming // nil for legacy framing
 }
 
 func (s SerialReader) ReadDevice() ([]byte, error) {
-	buf := make([]byte, 1)
-	ret := make([]byte, 128)
-
-	i := 0
-	_, err := s.serial.Read(buf) // read one byte at a time
-	if err == nil {
-		ret[i] = buf[0] // first byte is ID
-		i++
-
-		s.serial.Read(buf)
-		ret[i] = buf[0] // next byte is length
-		lenInMsg := int(buf[0])
-		i++
-
-		var mlen int
-		if lenInMsg < 128 { // never trust input
-			mlen = lenInMsg
-		} else {
-			mlen = 128 // limit mlen to avoid overflow
-		}
+	mtype := make([]byte, 1)
+	if _, err := io.ReadFull(s.serial, mtype); err != nil {
+		return []byte{}, err
+	}
 
-		for j := i; j < mlen; j++ { // the rest is payload
-			s.serial.Read(buf)
-			ret[j] = buf[0]
-		}
+	// framing may change with the hello ack, only known once a message starts;
+	// hello and hello ack are always in legacy framing
+	framing := s.framing.get()
+	if mtype[0] == MSG_HELLO || mtype[0] == MSG_HELLO_ACK {
+		framing = Framing{}
+	}
+	lenField := make([]byte, framing.lenSize())
+	if _, err := io.ReadFull(s.serial, lenField); err != nil {
+		return []byte{}, FramingError("truncated message: " + err.Error())
+	}
 
-		return ret[:mlen], nil
+	mlen := framing.decodeLen(lenField) // never trust input
+	if mlen < framing.headerSize()+framing.trailerSize() {
+		return []byte{}, FramingError(fmt.Sprintf("invalid message length %d", mlen))
+	}
+	if mlen > framing.maxLen() {
+		return []byte{}, FramingError(fmt.Sprintf("oversized message: %d bytes, limit %d", mlen, framing.maxLen()))
+	}
 
-	} else {
-		return []byte{}, err
+	buf := make([]byte, mlen)
+	buf[0] = mtype[0]
+	copy(buf[1:], lenField)
+	start := 1 + len(lenField)
+	if n, err := io.ReadFull(s.serial, buf[start:]); err != nil {
+		return []byte{}, FramingError(fmt.Sprintf("truncated message: %d of %d bytes: %s", start+n, mlen, err.Error()))
+	}
+
+	if mtype[0] == MSG_HELLO_ACK {
+		s.framing.accept(buf)
 	}
+	return buf, nil
 }
 
 func calcChecksum(data []byte) byte {
@@ -104,172 +115,288 @@ func calcChecksum(data []byte) byte {
 	return csum
 }
 
-func receiveWithTimeout(rxch <-chan []byte, timeout time.Duration) ([]byte, error) {
-	select {
-	case <-time.After(timeout * time.Second):
-		return nil, fmt.Errorf("serial read timeout")
-
-	case buf := <-rxch:
-		return buf, nil
-	}
-}
-
-// FOR LOOPBACK TESTING ONLY, simply exits when device not available
-// TODO: hard code path
-func testWriteSerial(stopch chan bool) {
-	c := &serial.Config{Name: "/dev/pts/4", Baud: 9600}
-	s, err := serial.OpenPort(c)
-	if err != nil {
-		fmt.Println("error opening loopback test serial interface:", err.Error())
-		close(stopch)
-		return
-	}
-	defer s.Close()
-
-	serial := SerialReader{s}
-	testrxch := devreader.MakeChannel(serial)
+// timing of the node serial link
+const (
+	HELLO_TIMEOUT      = 2 * time.Second  // doubled on every repeated hello
+	HELLO_RETRIES      = 4                // hellos without ack before the link is down
+	KEEPALIVE_INTERVAL = 10 * time.Second // hello sent after this long without traffic
+	RECONNECT_MIN      = 1 * time.Second  // doubled on every failed attempt
+	RECONNECT_MAX      = 30 * time.Second
+)
 
-LOOP:
+// read messages until the port fails; malformed messages are skipped
+func readSerial(serial SerialReader, rxch chan<- []byte, errch chan<- error, done <-chan bool) {
 	for {
-		select {
-		case <-stopch:
-			break LOOP
-
-		case buf := <-testrxch:
-			if len(buf) == 0 {
-				continue
-			}
-
-			rcvd := Message{}
-			err := rcvd.ParseBuffer(buf)
-			if err != nil {
-				fmt.Println("error parsing buffer:", err.Error())
-				debug := Message{4, buf}
-				msgDebug := debug.GenerateMessage()
-				s.Write(msgDebug)
-				continue
-			}
-
-			switch rcvd.mtype {
-			case 1:
-				helloAck := Message{2, []byte{}}
-				msgHelloAck := helloAck.GenerateMessage()
-				s.Write(msgHelloAck)
-
-				test := Message{4, []byte{0xde, 0xad, 0xca, 0xfe}}
-				msgTest := test.GenerateMessage()
-				s.Write(msgTest)
-
-			case 2:
-				continue
-
-			case 3:
-				fmt.Println("received application message:", hex.EncodeToString(rcvd.data))
-
-			case 4:
-				fmt.Println("received debug message:", hex.EncodeToString(rcvd.data))
-
+		buf, err := serial.ReadDevice()
+		if _, ok := err.(FramingError); ok {
+			fmt.Println("error reading serial:", err.Error())
+			continue
+		}
+		if err != nil {
+			select {
+			case errch <- err:
+			case <-done:
 			}
+			return
+		}
 
-		case <-time.After(30 * time.Second):
-			msg := Message{mtype: 4, data: []byte{0xde, 0xad, 0xbe, 0xef}}
-			buf := msg.GenerateMessage()
-			s.Write(buf)
-			fmt.Println("test: written to serial:", hex.EncodeToString(buf))
+		select {
+		case rxch <- buf:
+		case <-done:
+			return
 		}
 	}
-	fmt.Println("testWriteSerial stopped")
 }
 
-// main goroutine loop
-func DoSerialDataRequest(dlCh, ulCh chan []byte, device string) {
+// main goroutine loop; link up and down are reported on linkCh, which is closed
+// together with ulCh when the worker stops. serial errors are handled by
+// reconnecting, the returned error is for the supervisor
+func DoSerialDataRequest(dlCh, ulCh chan []byte, link transport.Endpoint, linkCh chan<- bool) error {
+	return serveSerial(dlCh, ulCh, link.String(), link.Open, linkCh)
+}
+
+// serial worker on the port returned by open, called again on every reconnect
+func serveSerial(dlCh, ulCh chan []byte, name string, open func() (io.ReadWriteCloser, error), linkCh chan<- bool) error {
 	// trailing LQI, ED, RX status, RX slot; TODO, all zeros for now
 	// I have to add one 0x00 to remove server error!! why!!
 	var trail = []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
 
-	c := &serial.Config{Name: device, Baud: 9600}
-	s, err := serial.OpenPort(c)
-	if err != nil {
-		fmt.Println("error opening serial interface:", err.Error())
-		os.Exit(1)
-	}
-	defer s.Close()
-
-	serial := SerialReader{s}
-	rxch := devreader.MakeChannel(serial)
+	var s io.ReadWriteCloser // nil while disconnected
+	var rxch chan []byte
+	var errch chan error
+	var done chan bool
+	hello := Message{MSG_HELLO, []byte{CAP_SEQ | CAP_CRC16 | CAP_LONG_LEN}}
+	linkFraming := &linkFraming{offer: hello.data[0]}
+	framing := Framing{}
+	// data requests are confirmed once the node acknowledges them
+	sender := arqSender{confirm: func(handle, status byte) { ulCh <- MakeDataCon(handle, status) }}
+	receiver := arqReceiver{last: -1}
 
-	// automatic serial sender just for testing
-	stopch := make(chan bool)
-	go testWriteSerial(stopch)
-
-	// handshake
-	hello := Message{1, []byte{}}
 	msgHello := hello.GenerateMessage()
-	s.Write(msgHello)
-	fmt.Println("sent hello:", hex.EncodeToString(msgHello), "waiting for ack...")
-	buf, err := receiveWithTimeout(rxch, 10)
-	fmt.Println("received hello ack:", hex.EncodeToString(buf))
-	if err != nil {
-		fmt.Println("error reading serial handshake:", err.Error())
-		os.Exit(1)
+	hellos := 0
+	var helloTimeout <-chan time.Time
+
+	up := false
+	lastRx := clock.Now()
+	keepalive := clock.NewTicker(KEEPALIVE_INTERVAL)
+	defer keepalive.Stop()
+
+	backoff := RECONNECT_MIN
+	reconnect := clock.After(0)
+
+	setLink := func(state bool) {
+		if up != state {
+			up = state
+			fmt.Println("node serial link up:", up)
+			linkCh <- up
+		}
 	}
-	rcvd := Message{}
-	rcvd.ParseBuffer(buf)
-	if rcvd.mtype != 2 {
-		fmt.Println("invalid hello ack")
-		os.Exit(1)
+
+	// handshake, always in legacy framing; any hello resets the node to the
+	// legacy framing, the ack tells which capabilities it accepts. the link keeps
+	// its framing until the ack, messages sent before the hello come in it
+	sendHello := func() {
+		s.Write(msgHello)
+		fmt.Println("sent hello:", hex.EncodeToString(msgHello), "waiting for ack...")
+		helloTimeout = clock.After(HELLO_TIMEOUT << uint(hellos))
+		hellos++
 	}
 
-LOOP:
+	disconnect := func() {
+		close(done)
+		s.Close()
+		s, rxch, errch, helloTimeout = nil, nil, nil, nil
+		sender.drop() // pending messages are dropped with the link
+		sender = arqSender{confirm: sender.confirm}
+		setLink(false)
+		reconnect = clock.After(backoff)
+		backoff *= 2
+		if backoff > RECONNECT_MAX {
+			backoff = RECONNECT_MAX
+		}
+	}
+
+	defer func() {
+		if s != nil {
+			close(done)
+			s.Close()
+		}
+		close(linkCh)
+		close(ulCh)
+		fmt.Println("serial worker stopped")
+	}()
+
 	for {
 		select {
 		case buf, more := <-dlCh:
 			if !more {
 				fmt.Println("stopping serial worker...")
-				close(ulCh)
-				break LOOP
+				return nil
 			}
 
 			wdcReq := WDC_REQ{}
-			wdcReq.ParseWDCReq(buf)
+			if err := wdcReq.ParseWDCReq(buf); err != nil {
+				fmt.Println("invalid data request:", err.Error())
+				continue
+			}
+			// the real node acknowledges on the air, the confirmation only tells
+			// whether the request reached it
+			confirm := func(status byte) {
+				if wdcReq.ACKREQ {
+					ulCh <- MakeDataCon(wdcReq.HANDLE, status)
+				}
+			}
+
+			if !up {
+				fmt.Println("node serial link down, dropped data request")
+				confirm(MAC_NO_ACK)
+				continue
+			}
 			if wdcReq.MSDULEN != len(wdcReq.MSDU) {
 				fmt.Println("MSDU length mismatch, on frame:", wdcReq.MSDULEN, ", received:", len(wdcReq.MSDU))
+				confirm(MAC_INVALID_PARAMETER)
 				continue
 			}
 
 			MSDU := make([]byte, len(wdcReq.MSDU))
 			copy(MSDU, wdcReq.MSDU) // if I don't do this the MSDU gets corrupted!?!?!?
 			MPDU := MakeMPDU([]byte{0x01, 0x98}, wdcReq.DSTPAN, wdcReq.DSTADDR, []byte{0xff, 0xff}, []byte{0xff, 0xff}, MSDU)
-			app := Message{mtype: 3, data: MPDU}
-			msgApp := app.GenerateMessage()
-			s.Write(msgApp)
-			fmt.Println("written to serial:", hex.EncodeToString(msgApp))
+			app := Message{mtype: MSG_APP, data: MPDU}
+			if !framing.fits(app) {
+				fmt.Println("data request too long for the serial link:", len(MPDU))
+				confirm(MAC_INVALID_PARAMETER)
+				continue
+			}
+			send := sender.send
+			if wdcReq.ACKREQ {
+				send = func(msg Message) []byte { return sender.sendConfirmed(msg, wdcReq.HANDLE) }
+			}
+			if msgApp := send(app); msgApp != nil {
+				s.Write(msgApp)
+				fmt.Println("written to serial:", hex.EncodeToString(msgApp))
+			}
+
+		case <-reconnect:
+			reconnect = nil
+			port, err := open()
+			if err != nil {
+				fmt.Println("error opening serial interface", name+":", err.Error(), "retry in", backoff)
+				reconnect = clock.After(backoff)
+				backoff *= 2
+				if backoff > RECONNECT_MAX {
+					backoff = RECONNECT_MAX
+				}
+				continue
+			}
+
+			s = port
+			rxch, errch, done = make(chan []byte), make(chan error), make(chan bool)
+			linkFraming.set(Framing{})
+			go readSerial(SerialReader{s, linkFraming}, rxch, errch, done)
+			hellos = 0
+			sendHello()
+
+		case <-helloTimeout:
+			if hellos >= HELLO_RETRIES {
+				fmt.Println("no hello ack from node, reconnecting")
+				disconnect()
+				continue
+			}
+			sendHello()
+
+		case <-keepalive.C:
+			if up && helloTimeout == nil && clock.Since(lastRx) >= KEEPALIVE_INTERVAL {
+				hellos = 0
+				sendHello()
+			}
+
+		case err := <-errch:
+			fmt.Println("error reading serial interface", name+":", err.Error())
+			disconnect()
+
+		case <-sender.timeout():
+			if msgApp := sender.expire(); msgApp != nil {
+				s.Write(msgApp)
+				fmt.Println("retransmitted to serial:", hex.EncodeToString(msgApp))
+			}
 
 		case buf := <-rxch:
+			lastRx = clock.Now()
 			if len(buf) == 0 {
 				continue
 			}
 
-			rcvd := Message{}
-			err := rcvd.ParseBuffer(buf)
+			// while a keepalive hello waits for its ack the link is up and other
+			// messages are handled as usual
+			ack := Message{}
+			isAck := ack.ParseBuffer(buf) == nil && ack.mtype == MSG_HELLO_ACK
+			if helloTimeout != nil && !isAck && !up {
+				fmt.Println("invalid hello ack:", hex.EncodeToString(buf))
+				continue
+			}
+			if isAck {
+				if helloTimeout == nil {
+					continue // not asked for
+				}
+				fmt.Println("received hello ack:", hex.EncodeToString(buf))
+
+				framing = linkFraming.get() // negotiated by the reader
+				fmt.Printf("serial framing: sequenced %v, CRC-16 %v, long messages %v\n",
+					framing.Caps&CAP_SEQ != 0, framing.Caps&CAP_CRC16 != 0, framing.Caps&CAP_LONG_LEN != 0)
+
+				helloTimeout = nil
+				backoff = RECONNECT_MIN
+				receiver = arqReceiver{framing: framing, last: -1}
+				if msgApp := sender.restart(framing); msgApp != nil {
+					s.Write(msgApp)
+				}
+				setLink(true)
+				continue
+			}
+
+			rcvd, seq, err := framing.Decode(buf)
 			if err != nil {
 				fmt.Println("error parsing buffer:", err.Error(), hex.EncodeToString(buf))
+				if framing.Caps&CAP_SEQ != 0 && len(buf) > 2 {
+					s.Write(receiver.reject(seq))
+				}
 				continue
 			}
 
 			switch rcvd.mtype {
-			case 1, 2:
+			case MSG_HELLO, MSG_HELLO_ACK:
 				continue
 
-			case 3:
+			case MSG_ACK, MSG_NAK:
+				next := sender.ack(seq)
+				if rcvd.mtype == MSG_NAK {
+					next = sender.nak(seq)
+				}
+				if next != nil {
+					s.Write(next)
+					fmt.Println("written to serial:", hex.EncodeToString(next))
+				}
+				continue
+			}
+
+			if framing.Caps&CAP_SEQ != 0 {
+				ack, isNew := receiver.receive(seq)
+				s.Write(ack)
+				if !isNew {
+					fmt.Println("dropped duplicate serial message:", seq)
+					continue
+				}
+			}
+
+			switch rcvd.mtype {
+			case MSG_APP:
 				ind := MakeWDCInd(rcvd.data, trail) // rcvd.data must be an MPDU
 				ulCh <- ind
 
-			case 4:
+			case MSG_DEBUG:
 				fmt.Println("received debug message:", hex.EncodeToString(rcvd.data))
 
 			}
 		}
 	}
-	fmt.Println("serial worker stopped")
 }
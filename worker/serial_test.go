@@ -3,7 +3,12 @@ package worker
 import (
 	"bytes"
 	"encoding/hex"
+	"fmt"
+	"github.com/herrfz/coordnode/clock"
+	"io"
+	"net"
 	"testing"
+	"time"
 )
 
 type testpair struct {
@@ -44,3 +49,61 @@ func TestParseBuffer(t *testing.T) {
 		}
 	}
 }
+
+// messages from the node between a keepalive hello and its ack are delivered
+// in the negotiated framing
+func TestSerialKeepalive(t *testing.T) {
+	v := clock.NewVirtual(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+	v.Settle = 50 * time.Millisecond
+	clock.Set(v)
+	defer clock.Set(clock.Real)
+
+	workerEnd, nodeEnd := net.Pipe()
+	defer nodeEnd.Close()
+	opened := false
+	open := func() (io.ReadWriteCloser, error) {
+		if opened {
+			return nil, fmt.Errorf("already opened")
+		}
+		opened = true
+		return workerEnd, nil
+	}
+	dlCh, ulCh, linkCh := make(chan []byte), make(chan []byte), make(chan bool, 4)
+	go serveSerial(dlCh, ulCh, "pipe", open, linkCh)
+
+	framing := Framing{CAP_SEQ | CAP_CRC16}
+	node := SerialReader{nodeEnd, &linkFraming{}}
+	if buf, err := node.ReadDevice(); err != nil || buf[0] != MSG_HELLO {
+		t.Fatalf("no hello: %v, %v", hex.EncodeToString(buf), err)
+	}
+	node.framing.set(framing)
+	nodeEnd.Write((&Message{MSG_HELLO_ACK, []byte{framing.Caps}}).GenerateMessage())
+	if up := <-linkCh; !up {
+		t.Fatalf("link not reported up")
+	}
+
+	if buf, err := node.ReadDevice(); err != nil || buf[0] != MSG_HELLO { // keepalive
+		t.Fatalf("no keepalive hello: %v, %v", hex.EncodeToString(buf), err)
+	}
+	mpdu := MakeMPDU([]byte{0x01, 0x98}, []byte{0xb1, 0xca}, []byte{0x01, 0x00}, []byte{0xff, 0xff}, []byte{0xff, 0xff}, []byte{0xca, 0xfe})
+	nodeEnd.Write(framing.Encode(Message{MSG_APP, mpdu}, 0))
+
+	ack, err := node.ReadDevice()
+	if out := framing.Encode(Message{MSG_ACK, []byte{}}, 0); err != nil || !bytes.Equal(ack, out) {
+		t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(ack), hex.EncodeToString(out))
+	}
+	select {
+	case ind := <-ulCh:
+		if out := MakeWDCInd(mpdu, []byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00}); !bytes.Equal(ind, out) {
+			t.Errorf("wrong output: %v, expected: %v", hex.EncodeToString(ind), hex.EncodeToString(out))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("no indication from the node")
+	}
+
+	nodeEnd.Write((&Message{MSG_HELLO_ACK, []byte{framing.Caps}}).GenerateMessage())
+	close(dlCh)
+	if _, more := <-ulCh; more {
+		t.Errorf("uplink channel not closed")
+	}
+}
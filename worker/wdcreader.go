@@ -0,0 +1,104 @@
+package worker
+
+import (
+	"io"
+	"sync"
+)
+
+// longest WDC message after the length byte: WDC_MAC_DATA_REQ with long
+// destination address (14 bytes header) and a full 127 byte MSDU
+const WDC_MAX_LEN = 14 + 127
+
+// shortest valid message after the length byte, for commands with parameters
+var wdcMinLen = map[byte]int{
+	0x07: 9, // set long address: cmd, 8 bytes address
+	0x17: 8, // data request: cmd, handle, tx options, pan, short addr, msdu length
+}
+
+type WDCReaderStats struct {
+	Frames    int // complete messages returned
+	Resyncs   int // times the reader lost and searched for the frame start
+	Discarded int // bytes dropped while resynchronising
+}
+
+// WDCReader splits the byte stream from the wdc into length-prefixed
+// messages, however the bytes are spread over the underlying reads
+type WDCReader struct {
+	rd         io.Reader
+	buf        []byte
+	discarding bool
+	stats      WDCReaderStats
+	mutex      sync.Mutex // protect stats, read from another goroutine
+}
+
+func NewWDCReader(rd io.Reader) *WDCReader {
+	return &WDCReader{rd: rd}
+}
+
+// ReadDevice returns one message, so WDCReader implements devreader interface
+func (r *WDCReader) ReadDevice() ([]byte, error) {
+	chunk := make([]byte, WDC_MAX_LEN+1) // a whole message, datagram transports cut longer reads
+	for {
+		if frame := r.nextFrame(); frame != nil {
+			return frame, nil
+		}
+
+		n, err := r.rd.Read(chunk)
+		r.buf = append(r.buf, chunk[:n]...)
+		if err != nil {
+			return []byte{}, err // partial message is kept for the next call
+		}
+	}
+}
+
+func (r *WDCReader) Stats() WDCReaderStats {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.stats
+}
+
+// take the next complete message off the buffer, nil if more bytes are needed
+func (r *WDCReader) nextFrame() []byte {
+	for len(r.buf) > 0 {
+		msgLen := int(r.buf[0])
+		valid := msgLen > 0 && msgLen <= WDC_MAX_LEN
+		if valid && len(r.buf) > 1 {
+			if minLen, ok := wdcMinLen[r.buf[1]]; ok && msgLen < minLen {
+				valid = false
+			}
+		}
+
+		if !valid {
+			r.discard()
+			continue
+		}
+
+		if len(r.buf) < msgLen+1 {
+			return nil
+		}
+
+		frame := make([]byte, msgLen+1)
+		copy(frame, r.buf)
+		r.buf = r.buf[msgLen+1:]
+
+		r.mutex.Lock()
+		r.stats.Frames++
+		r.mutex.Unlock()
+		r.discarding = false
+		return frame
+	}
+	return nil
+}
+
+// drop one byte and try the next one as frame start
+func (r *WDCReader) discard() {
+	r.mutex.Lock()
+	if !r.discarding {
+		r.stats.Resyncs++
+	}
+	r.stats.Discarded++
+	r.mutex.Unlock()
+
+	r.discarding = true
+	r.buf = r.buf[1:]
+}
@@ -0,0 +1,64 @@
+package worker
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"testing/iotest"
+)
+
+var (
+	connect   = []byte{0x01, 0x01}
+	tdmaStart = []byte{0x03, 0x11, 0xca, 0xfe}
+	dataReq   = []byte{0x09, 0x17, 0x01, 0x00, 0xb1, 0xca, 0x01, 0x00, 0x01, 0xde}
+)
+
+func readFrames(t *testing.T, r *WDCReader, n int) [][]byte {
+	var frames [][]byte
+	for i := 0; i < n; i++ {
+		frame, err := r.ReadDevice()
+		if err != nil {
+			t.Fatalf("error reading frame %d: %v", i, err.Error())
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+func checkFrames(t *testing.T, frames [][]byte, out ...[]byte) {
+	for i := range out {
+		if !bytes.Equal(frames[i], out[i]) {
+			t.Errorf("wrong frame %d: %v, expected: %v", i, hex.EncodeToString(frames[i]), hex.EncodeToString(out[i]))
+		}
+	}
+}
+
+func TestWDCReaderSplit(t *testing.T) {
+	stream := append(append(append([]byte{}, connect...), dataReq...), tdmaStart...)
+	r := NewWDCReader(iotest.OneByteReader(bytes.NewReader(stream)))
+
+	checkFrames(t, readFrames(t, r, 3), connect, dataReq, tdmaStart)
+	if stats := r.Stats(); stats != (WDCReaderStats{Frames: 3}) {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+}
+
+func TestWDCReaderCoalesced(t *testing.T) {
+	stream := append(append(append([]byte{}, tdmaStart...), connect...), dataReq...)
+	r := NewWDCReader(bytes.NewReader(stream))
+
+	checkFrames(t, readFrames(t, r, 3), tdmaStart, connect, dataReq)
+}
+
+func TestWDCReaderResync(t *testing.T) {
+	// zero and oversized lengths
+	stream := append([]byte{0x00, 0xff, 0xc8}, connect...)
+	stream = append(stream, 0x00, 0x00)
+	stream = append(stream, dataReq...)
+	r := NewWDCReader(bytes.NewReader(stream))
+
+	checkFrames(t, readFrames(t, r, 2), connect, dataReq)
+	if stats := r.Stats(); stats != (WDCReaderStats{Frames: 2, Resyncs: 2, Discarded: 5}) {
+		t.Errorf("wrong stats: %+v", stats)
+	}
+}